@@ -0,0 +1,220 @@
+package memcacheha
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// DEFAULT_CHUNK_SIZE is the default largest value written as a single item, see Client.ChunkSize. It is below
+// memcached's default 1MB item size limit, leaving room for the key.
+const DEFAULT_CHUNK_SIZE = 1000 * 1000
+
+// MAX_HEADER_LENGTH is the most the memcacheha header and encryption add to the length of a value
+const MAX_HEADER_LENGTH = 1024
+
+// MANIFEST_ID_LENGTH is the length of the random id distinguishing the chunks of each write of a chunked value
+const MANIFEST_ID_LENGTH = 8
+
+// ErrInvalidManifest is an error meaning the value of a chunked item is not a valid manifest
+var ErrInvalidManifest = errors.New("memcacheha: invalid chunk manifest")
+
+// manifest describes the chunks holding a chunked value. It is the value of the item stored under the key of the value.
+type manifest struct {
+	id     []byte
+	count  int
+	length int
+}
+
+// newManifest returns a new manifest with a random id, for a value of the given length split into chunks holding
+// chunkLength bytes each
+func newManifest(length int, chunkLength int) (*manifest, error) {
+	id := make([]byte, MANIFEST_ID_LENGTH)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &manifest{
+		id:     id,
+		count:  (length + chunkLength - 1) / chunkLength,
+		length: length,
+	}, nil
+}
+
+// chunkLength returns the length of the value held by each chunk, so it is at most ChunkSize with the header
+func (client *Client) chunkLength() int {
+	return client.ChunkSize - MAX_HEADER_LENGTH
+}
+
+// decodeManifest returns the manifest encoded in the given value
+func decodeManifest(value []byte) (*manifest, error) {
+	if len(value) != MANIFEST_ID_LENGTH+12 {
+		return nil, ErrInvalidManifest
+	}
+	return &manifest{
+		id:     value[:MANIFEST_ID_LENGTH],
+		count:  int(binary.BigEndian.Uint32(value[MANIFEST_ID_LENGTH:])),
+		length: int(binary.BigEndian.Uint64(value[MANIFEST_ID_LENGTH+4:])),
+	}, nil
+}
+
+// encode returns this manifest as a value: the id, the big-endian 32 bit number of chunks, and the big-endian 64 bit
+// length of the value
+func (manifest *manifest) encode() []byte {
+	value := make([]byte, MANIFEST_ID_LENGTH+12)
+	copy(value, manifest.id)
+	binary.BigEndian.PutUint32(value[MANIFEST_ID_LENGTH:], uint32(manifest.count))
+	binary.BigEndian.PutUint64(value[MANIFEST_ID_LENGTH+4:], uint64(manifest.length))
+	return value
+}
+
+// chunkKeys returns the keys of the chunks of the value with the given key. Keys are of a fixed length, whatever the
+// length of the key of the value.
+func (manifest *manifest) chunkKeys(key string) []string {
+	keys := make([]string, manifest.count)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("memcacheha:chunk:%x:%x:%d", sha1.Sum([]byte(key)), manifest.id, i)
+	}
+	return keys
+}
+
+// chunk writes the chunks of the given item to all healthy nodes, if its value is longer than ChunkSize once encoded,
+// and returns the manifest item to write in its place. Otherwise, or for raw keys, the given item is returned.
+func (client *Client) chunk(ctx context.Context, item *Item) (*Item, error) {
+	if len(item.Value)+MAX_HEADER_LENGTH <= client.ChunkSize || client.Encoding.isRaw(item.Key) {
+		return item, nil
+	}
+
+	// Longer values may be short enough once compressed, or too long with the header
+	mcItem, err := item.encode(&client.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	if len(mcItem.Value) <= client.ChunkSize {
+		return item, nil
+	}
+
+	chunkLength := client.chunkLength()
+	manifest, err := newManifest(len(item.Value), chunkLength)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write chunks before the manifest, so the manifest is never read without them
+	for i, key := range manifest.chunkKeys(item.Key) {
+		end := (i + 1) * chunkLength
+		if end > len(item.Value) {
+			end = len(item.Value)
+		}
+		err := client.SetContext(ctx, &Item{
+			Key:        key,
+			Value:      item.Value[i*chunkLength : end],
+			Expiration: item.Expiration,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	manifestItem := *item
+	manifestItem.Value = manifest.encode()
+	manifestItem.chunked = true
+	return &manifestItem, nil
+}
+
+// discardChunks deletes the chunks of the given manifest item from all healthy nodes, when no node stores the manifest,
+// rather than leaving them to expire. Nothing is done for other items.
+func (client *Client) discardChunks(item *Item) {
+	if !item.chunked {
+		return
+	}
+	manifest, err := decodeManifest(item.Value)
+	if err != nil {
+		return
+	}
+
+	nodes := client.Nodes.GetHealthyNodes()
+	keys := manifest.chunkKeys(item.Key)
+	statusChan := make(chan (*NodeResponse), len(nodes)*len(keys))
+	for _, key := range keys {
+		for _, node := range nodes {
+			node.Delete(key, statusChan)
+		}
+	}
+	for i := 0; i < len(nodes)*len(keys); i++ {
+		<-statusChan
+	}
+	client.Log.Info("Discarded %d chunks of %s", len(keys), item.Key)
+}
+
+// unchunk reads the chunks of the given manifest item, returning a copy of the item with the value they hold. Otherwise
+// the given item is returned. ErrCacheMiss is returned if any chunk is missing.
+func (client *Client) unchunk(ctx context.Context, item *Item) (*Item, error) {
+	items, err := client.unchunkMulti(ctx, map[string]*Item{item.Key: item})
+	if err != nil {
+		return nil, err
+	}
+	item, found := items[item.Key]
+	if !found {
+		return nil, memcache.ErrCacheMiss
+	}
+	return item, nil
+}
+
+// unchunkMulti reads the chunks of all manifest items in the given map with one GetMulti, replacing each with a copy
+// holding its value. Items with missing chunks are removed. Items returned alongside ErrInsufficientReplicas met the
+// read consistency for all chunks.
+func (client *Client) unchunkMulti(ctx context.Context, items map[string]*Item) (map[string]*Item, error) {
+	manifests := map[string]*manifest{}
+	var keys []string
+	for key, item := range items {
+		if !item.chunked {
+			continue
+		}
+		manifest, err := decodeManifest(item.Value)
+		if err != nil {
+			client.Log.Warn("Reading manifest for %s: %s", key, err)
+			delete(items, key)
+			continue
+		}
+		manifests[key] = manifest
+		keys = append(keys, manifest.chunkKeys(key)...)
+	}
+	if len(manifests) == 0 {
+		return items, nil
+	}
+
+	// Chunks are synchronised by GetMulti individually
+	chunks, err := client.GetMultiContext(ctx, keys)
+	if err != nil && err != ErrInsufficientReplicas {
+		return nil, err
+	}
+
+	for key, manifest := range manifests {
+		value := make([]byte, 0, manifest.length)
+		for _, chunkKey := range manifest.chunkKeys(key) {
+			chunk, found := chunks[chunkKey]
+			if !found {
+				break
+			}
+			value = append(value, chunk.Value...)
+		}
+
+		// Missing chunks, or the wrong length, is a partial value
+		if len(value) != manifest.length {
+			client.Log.Warn("Chunks missing for %s", key)
+			delete(items, key)
+			continue
+		}
+
+		item := *items[key]
+		item.Value = value
+		item.chunked = false
+		items[key] = &item
+	}
+	return items, err
+}
@@ -0,0 +1,214 @@
+package memcacheha
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// testChunkSize is a chunk size small enough for tests to write values of several chunks quickly
+const testChunkSize = 4 * MAX_HEADER_LENGTH
+
+func TestManifestRoundTrip(t *testing.T) {
+	manifest, err := newManifest(2*testChunkSize+1, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.count != 3 {
+		t.Errorf("expected 3 chunks, got %d", manifest.count)
+	}
+
+	item := &Item{Key: "foo", Value: manifest.encode(), chunked: true}
+	out, err := NewItemFromMemcacheItem(item.AsMemcacheItem())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !out.chunked {
+		t.Fatal("expected chunked item")
+	}
+	decoded, err := decodeManifest(out.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.id, manifest.id) || decoded.count != manifest.count || decoded.length != manifest.length {
+		t.Errorf("expected %+v, got %+v", manifest, decoded)
+	}
+
+	if _, err := decodeManifest([]byte("foo")); err != ErrInvalidManifest {
+		t.Errorf("expected ErrInvalidManifest, got %v", err)
+	}
+}
+
+func TestManifestChunkKeys(t *testing.T) {
+	manifest, err := newManifest(3*testChunkSize, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	short := manifest.chunkKeys("foo")
+	long := manifest.chunkKeys(strings.Repeat("x", 250))
+	if len(short) != 3 {
+		t.Fatalf("expected 3 keys, got %d", len(short))
+	}
+	for i := range short {
+		if len(short[i]) != len(long[i]) || len(long[i]) > 250 {
+			t.Errorf("expected fixed length keys within 250 bytes, got %q and %q", short[i], long[i])
+		}
+		if short[i] == long[i] {
+			t.Errorf("expected different keys for different values, got %q", short[i])
+		}
+	}
+}
+
+func TestChunkEncodedSize(t *testing.T) {
+	// A long value short enough once compressed is not chunked
+	compressed, compressedServers := newTestCluster(t, 1, WithChunkSize(testChunkSize), WithEncoding(Encoding{Compressor: &GzipCompressor{Level: 9}}))
+	value := bytes.Repeat([]byte("compressible "), testChunkSize)
+	if err := compressed.Set(&Item{Key: "foo", Value: value}); err != nil {
+		t.Fatal(err)
+	}
+	if keys := compressedServers[0].keys(); keys != 1 {
+		t.Errorf("expected compressed value in 1 item, got %d", keys)
+	}
+
+	// A value short enough without the header is chunked, and each chunk fits with its header
+	client, servers := newTestCluster(t, 1, WithChunkSize(testChunkSize), WithEncoding(Encoding{Checksum: true}))
+	value = bytes.Repeat([]byte("x"), testChunkSize-10)
+	if err := client.Set(&Item{Key: "foo", Value: value}); err != nil {
+		t.Fatal(err)
+	}
+	if keys := servers[0].keys(); keys != 3 {
+		t.Errorf("expected manifest and 2 chunks, got %d items", keys)
+	}
+	stored, _ := servers[0].value("foo")
+	manifestItem, err := decodeItem(&memcache.Item{Key: "foo", Value: stored}, &client.Encoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := decodeManifest(manifestItem.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range manifest.chunkKeys("foo") {
+		if stored, _ := servers[0].value(key); len(stored) > testChunkSize {
+			t.Errorf("expected %s within the chunk size, got %d bytes", key, len(stored))
+		}
+	}
+	item, err := client.Get("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(item.Value, value) {
+		t.Errorf("expected %d byte value, got %d bytes", len(value), len(item.Value))
+	}
+}
+
+func TestChunkDiscard(t *testing.T) {
+	client, servers := newTestCluster(t, 2, WithChunkSize(testChunkSize))
+	if err := client.Set(&Item{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+	value := bytes.Repeat([]byte("x"), 2*testChunkSize)
+
+	// Chunks of manifests that are not stored are deleted
+	if err := client.Add(&Item{Key: "foo", Value: value}); err != memcache.ErrNotStored {
+		t.Fatalf("expected ErrNotStored, got %v", err)
+	}
+	if err := client.Replace(&Item{Key: "baz", Value: value}); err != memcache.ErrNotStored {
+		t.Fatalf("expected ErrNotStored, got %v", err)
+	}
+	item, err := client.GetForUpdate("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Set(&Item{Key: "foo", Value: []byte("qux")}); err != nil {
+		t.Fatal(err)
+	}
+	item.Value = value
+	if err := client.CompareAndSwap(item); err != memcache.ErrCASConflict {
+		t.Fatalf("expected ErrCASConflict, got %v", err)
+	}
+	for _, server := range servers {
+		if keys := server.keys(); keys != 1 {
+			t.Errorf("expected chunks to be deleted from %s, got %d items", server.endpoint(), keys)
+		}
+	}
+}
+
+func TestChunkPartialAdd(t *testing.T) {
+	client, servers := newTestCluster(t, 2, WithChunkSize(testChunkSize))
+	existing := bytes.Repeat([]byte("x"), 2*testChunkSize)
+	if err := client.Set(&Item{Key: "foo", Value: existing}); err != nil {
+		t.Fatal(err)
+	}
+	keys := servers[0].keys()
+
+	// The node missing the manifest stores the Add, and is restored with the existing manifest
+	servers[1].remove("foo")
+	if err := client.Add(&Item{Key: "foo", Value: bytes.Repeat([]byte("y"), 2*testChunkSize)}); err != memcache.ErrNotStored {
+		t.Fatalf("expected ErrNotStored, got %v", err)
+	}
+	for _, server := range servers {
+		for _, key := range server.storedKeys() {
+			if value, _ := server.value(key); len(value) > testChunkSize {
+				t.Errorf("expected no item longer than the chunk size on %s, got %d bytes for %s", server.endpoint(), len(value), key)
+			}
+		}
+		if server.keys() != keys {
+			t.Errorf("expected the chunks of the Add to be deleted from %s, got %d items", server.endpoint(), server.keys())
+		}
+	}
+	item, err := client.GetForUpdate("foo")
+	if err != nil || !bytes.Equal(item.Value, existing) {
+		t.Fatalf("expected the existing value, got %v", err)
+	}
+
+	// Chunks are kept while a node stores the manifest, here as the existing value expired before it was restored
+	expired := time.Now().Add(-time.Minute)
+	expiredItem, err := (&Item{Key: "foo", Value: []byte("old"), Expiration: &expired}).encode(&client.Encoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Nodes.GetNodes()[servers[0].endpoint()].client.Set(expiredItem); err != nil {
+		t.Fatal(err)
+	}
+	servers[1].remove("foo")
+	if err := client.Add(&Item{Key: "foo", Value: bytes.Repeat([]byte("z"), 2*testChunkSize)}); err != memcache.ErrNotStored {
+		t.Fatalf("expected ErrNotStored, got %v", err)
+	}
+	mcItem, _ := servers[1].value("foo")
+	manifestItem, err := decodeItem(&memcache.Item{Key: "foo", Value: mcItem}, &client.Encoding)
+	if err != nil || !manifestItem.chunked {
+		t.Fatalf("expected a manifest on %s, got %v", servers[1].endpoint(), err)
+	}
+	manifest, _ := decodeManifest(manifestItem.Value)
+	for _, key := range manifest.chunkKeys("foo") {
+		if _, found := servers[1].value(key); !found {
+			t.Errorf("expected chunk %s to be kept", key)
+		}
+	}
+}
+
+func TestChunkSizePerClient(t *testing.T) {
+	value := bytes.Repeat([]byte("x"), 2*testChunkSize)
+
+	// Clients in one process chunk values by their own chunk size
+	chunking, chunkingServers := newTestCluster(t, 1, WithChunkSize(testChunkSize))
+	client, servers := newTestCluster(t, 1)
+	if client.ChunkSize != DEFAULT_CHUNK_SIZE {
+		t.Errorf("expected default chunk size %d, got %d", DEFAULT_CHUNK_SIZE, client.ChunkSize)
+	}
+	for _, c := range []*Client{chunking, client} {
+		if err := c.Set(&Item{Key: "foo", Value: value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keys := chunkingServers[0].keys(); keys != 4 {
+		t.Errorf("expected manifest and 3 chunks, got %d items", keys)
+	}
+	if keys := servers[0].keys(); keys != 1 {
+		t.Errorf("expected value in 1 item, got %d", keys)
+	}
+}
@@ -2,6 +2,10 @@
 package memcacheha
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"strconv"
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
@@ -10,11 +14,16 @@ import (
 // VERSION is the version of this memcacheha client
 const VERSION = "0.1.0"
 
-var (
-	// GET_NODES_PERIOD is the period between checking all sources for new or deprecated nodes
-	GET_NODES_PERIOD = 10 * time.Second
-	// HEALTHCHECK_PERIOD is the period between healthchecks on nodes
-	HEALTHCHECK_PERIOD = 5 * time.Second
+const (
+	// DEFAULT_GET_NODES_PERIOD is the default period between checking all sources for new or deprecated nodes
+	DEFAULT_GET_NODES_PERIOD = 10 * time.Second
+	// DEFAULT_HEALTHCHECK_PERIOD is the default period between healthchecks on nodes
+	DEFAULT_HEALTHCHECK_PERIOD = 5 * time.Second
+	// DEFAULT_TIMEOUT is the default timeout of each operation on a node
+	DEFAULT_TIMEOUT = 100 * time.Millisecond
+	// DEFAULT_CAS_RETRIES is the default number of attempts made by read-modify-write operations such as Increment before
+	// returning ErrCASConflict
+	DEFAULT_CAS_RETRIES = 5
 )
 
 // Client represents the cluster client.
@@ -23,27 +32,77 @@ type Client struct {
 	Sources []NodeSource
 	Log     Logger
 
-	Timeout time.Duration
+	Timeout           time.Duration
+	GetNodesPeriod    time.Duration
+	HealthCheckPeriod time.Duration
+	CASRetries        int
 
+	ReadConsistency  Consistency
+	WriteConsistency Consistency
+
+	TombstoneTTL time.Duration
+
+	// ChunkSize is the largest value written as a single item, after compression, encryption and the memcacheha header.
+	// Longer values are split into chunks of at most this size, written under separate keys, followed by a manifest item
+	// under the key of the value. It must be greater than MAX_HEADER_LENGTH.
+	ChunkSize int
+
+	Encoding Encoding
+
+	// KeyTransformer transforms keys before they are validated and sent to nodes, if not nil, e.g. HashLongKeys. Items
+	// are returned with the key requested.
+	KeyTransformer KeyTransformer
+
+	// Metrics records instrumentation, see WithMetrics
+	Metrics Metrics
+
+	// Tracer starts spans for operations if not nil, see WithTracer
+	Tracer Tracer
+
+	events       *eventBus
 	shutdownChan chan (int)
 	running      bool
 }
 
-// New returns a new Client with the specified logger and NodeSources
-func New(logger Logger, sources ...NodeSource) *Client {
+// New returns a new Client configured with the given Options, e.g. New(WithLogger(logger), WithSources(source))
+func New(opts ...Option) *Client {
 	i := &Client{
-		Nodes:        NewNodeList(),
-		Sources:      sources,
-		Log:          logger,
-		Timeout:      100 * time.Millisecond,
-		shutdownChan: make(chan (int)),
-		running:      false,
+		Nodes:             NewNodeList(),
+		Log:               nopLogger{},
+		Timeout:           DEFAULT_TIMEOUT,
+		GetNodesPeriod:    DEFAULT_GET_NODES_PERIOD,
+		HealthCheckPeriod: DEFAULT_HEALTHCHECK_PERIOD,
+		CASRetries:        DEFAULT_CAS_RETRIES,
+		ChunkSize:         DEFAULT_CHUNK_SIZE,
+		Metrics:           nopMetrics{},
+		events:            newEventBus(),
+		shutdownChan:      make(chan (int)),
+		running:           false,
+	}
+	for _, opt := range opts {
+		opt(i)
 	}
+	i.events.subscribe(i.recordEvent)
+	i.Metrics.WatchNodes(i.Nodes)
 	return i
 }
 
 // Add writes the given item, if no value already exists for its key. ErrNotStored is returned if that condition is not met.
 func (client *Client) Add(item *Item) error {
+	return client.AddContext(context.Background(), item)
+}
+
+// AddContext is like Add, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (client *Client) AddContext(ctx context.Context, item *Item) (err error) {
+	ctx, op := client.startOperation(ctx, "Add", item.Key)
+	defer op.end(&err)
+	// Validate the key, and timestamp the write
+	item, err = client.storageItem(item)
+	if err != nil {
+		return err
+	}
+	item = item.withTimestamp(time.Now())
+
 	// Get all nodes that are marked healthy
 	nodes := client.Nodes.GetHealthyNodes()
 	nodeCount := len(nodes)
@@ -53,18 +112,31 @@ func (client *Client) Add(item *Item) error {
 		return ErrNoHealthyNodes
 	}
 
-	finishChan := make(chan (error))
+	// Bug out early if too few nodes to meet the write consistency
+	required := client.writeNodesRequired(ctx)
+	if nodeCount < required {
+		return ErrInsufficientReplicas
+	}
+
+	// Write the chunks of a long value, and the manifest in its place
+	item, err = client.chunk(ctx, item)
+	if err != nil {
+		return err
+	}
+
+	finishChan := make(chan (error), 1)
 	statusChan := make(chan (*NodeResponse), nodeCount)
 
+	nodeChan := client.traceNodes(ctx, "Add", item, nodes, statusChan)
+
 	// Concurrently write to all healthy nodes
 	for _, node := range nodes {
-		node.Add(item, statusChan)
+		node.Add(item, nodeChan)
 	}
 
-	// True if any node returns ErrNotStored
-	doSync := false
-	// These are the nodes that don't contain the value
-	var nodesToSync []*Node
+	// These are the nodes that stored the item, and the nodes that already hold a value
+	var storedNodes []*Node
+	var existingNodes []*Node
 
 	// Handle responses
 	go func() {
@@ -75,57 +147,244 @@ func (client *Client) Add(item *Item) error {
 			}
 		}()
 
+		// Nodes that stored the item, and errors from nodes that failed
+		result := &writeResult{}
+
 		// Get response from all nodes
 		for ; nodeCount > 0; nodeCount-- {
 			response := <-statusChan
 			if response.Error == memcache.ErrNotStored {
-				doSync = true
+				existingNodes = append(existingNodes, response.Node)
 			}
 			if response.Error == nil {
-				nodesToSync = append(nodesToSync, response.Node)
+				storedNodes = append(storedNodes, response.Node)
+			}
+			result.add(response, memcache.ErrNotStored)
+		}
+
+		// The Add failed if any node already holds a value, so restore it on the nodes that stored the item, even if
+		// ctx is done
+		if len(existingNodes) > 0 && len(storedNodes) > 0 {
+			if client.restoreExisting(context.WithoutCancel(ctx), item.Key, existingNodes, storedNodes) {
+				storedNodes = nil
 			}
-			// We ignore other errors
+		}
+
+		// Chunks are only referenced by a stored manifest
+		if len(storedNodes) == 0 {
+			client.discardChunks(item)
 		}
 
 		// Where there any ErrNotStored?
-		if doSync {
+		if len(existingNodes) > 0 {
+			finishChan <- memcache.ErrNotStored
+			return
+		}
+
+		// If this happened, writes to all nodes failed
+		if client.Nodes.GetHealthyNodeCount() == 0 {
+			finishChan <- ErrNoHealthyNodes
+			return
+		}
+
+		// Did enough nodes acknowledge the write, without any rejecting it?
+		finishChan <- result.err(required)
+	}()
+
+	// Wait for result or cancellation
+	select {
+	case err := <-finishChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// restoreExisting reads the item with the given key from the nodes that already held a value when it was added, and
+// writes the newest over the added item on the nodes that stored it. Items are read and written as stored, so the
+// manifest of a chunked value is restored rather than its value. True is returned if all stored nodes were restored.
+func (client *Client) restoreExisting(ctx context.Context, key string, existingNodes []*Node, storedNodes []*Node) bool {
+	readChan := make(chan (*NodeResponse), len(existingNodes))
+	for _, node := range existingNodes {
+		node.Get(key, readChan)
+	}
+	var existing *Item
+	for i := 0; i < len(existingNodes); i++ {
+		response := <-readChan
+		if response.Item != nil && (existing == nil || response.Item.newerThan(existing)) {
+			existing = response.Item
+		}
+	}
+
+	// The existing value expired or was evicted since it prevented the Add, the added item is left to be synchronised
+	if existing == nil {
+		client.Log.Warn("Add: Existing value for %s not found, not restoring %d nodes", key, len(storedNodes))
+		return false
+	}
+
+	// Write to all stored nodes unconditionally
+	if existing.Expiration != nil {
+		client.Log.Info("Add: Restoring %d nodes with %s expiry", len(storedNodes), *existing.Expiration)
+	} else {
+		client.Log.Info("Add: Restoring %d nodes", len(storedNodes))
+	}
+	repairChan := client.traceRepair(ctx, "Add", key, len(storedNodes))
+	statusChan := make(chan (*NodeResponse), len(storedNodes))
+	for _, node := range storedNodes {
+		node.Set(existing, statusChan)
+	}
+	restored := true
+	for i := 0; i < len(storedNodes); i++ {
+		response := <-statusChan
+		if response.Error != nil {
+			restored = false
+		}
+		if repairChan != nil {
+			repairChan <- response
+		}
+	}
+	client.events.emit(Event{Type: EVENT_REPAIR_PERFORMED, Op: "Add", Key: key, Nodes: len(storedNodes)})
+	return restored
+}
+
+// Replace writes the given item, but only if the server *does* already hold data for this key. ErrNotStored is returned
+// if that condition is not met on any node. Nodes that do not hold data for the key are synchronised if any other node
+// stored the item.
+func (client *Client) Replace(item *Item) error {
+	return client.ReplaceContext(context.Background(), item)
+}
+
+// ReplaceContext is like Replace, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (client *Client) ReplaceContext(ctx context.Context, item *Item) (err error) {
+	ctx, op := client.startOperation(ctx, "Replace", item.Key)
+	defer op.end(&err)
+	// Validate the key, and timestamp the write
+	item, err = client.storageItem(item)
+	if err != nil {
+		return err
+	}
+	item = item.withTimestamp(time.Now())
+
+	// Get all nodes that are marked healthy
+	nodes := client.Nodes.GetHealthyNodes()
+	nodeCount := len(nodes)
+
+	// Bug out early if no nodes
+	if nodeCount == 0 {
+		return ErrNoHealthyNodes
+	}
+
+	// Bug out early if too few nodes to meet the write consistency
+	required := client.writeNodesRequired(ctx)
+	if nodeCount < required {
+		return ErrInsufficientReplicas
+	}
+
+	// Write the chunks of a long value, and the manifest in its place
+	item, err = client.chunk(ctx, item)
+	if err != nil {
+		return err
+	}
+
+	finishChan := make(chan (error), 1)
+	statusChan := make(chan (*NodeResponse), nodeCount)
+
+	nodeChan := client.traceNodes(ctx, "Replace", item, nodes, statusChan)
+
+	// Concurrently write to all healthy nodes
+	for _, node := range nodes {
+		node.Replace(item, nodeChan)
+	}
+
+	// True if any node stores the item
+	stored := false
+	// These are the nodes that don't contain the key
+	var nodesToSync []*Node
+
+	// Handle responses
+	go func() {
+		defer func() {
+			r := recover()
+			if r != nil {
+				finishChan <- ErrUnknown
+			}
+		}()
+
+		// Nodes that stored the item, and errors from nodes that failed
+		result := &writeResult{}
+
+		// Get response from all nodes
+		for ; nodeCount > 0; nodeCount-- {
+			response := <-statusChan
+			if response.Error == memcache.ErrNotStored {
+				nodesToSync = append(nodesToSync, response.Node)
+			}
+			if response.Error == nil {
+				stored = true
+			}
+			result.add(response, memcache.ErrNotStored)
+		}
+
+		// Was the item stored on any node?
+		if stored {
 			if len(nodesToSync) > 0 {
-				client.Log.Info("Add: Synchronising %d nodes", len(nodesToSync))
-				// Re-read the original
-				item, err := client.Get(item.Key)
-				if err != nil {
-					// Write to all sync nodes unconditionally
-					if item.Expiration != nil {
-						client.Log.Info("Add: Synchronising %d nodes with %s expiry", len(nodesToSync), *item.Expiration)
-					} else {
-						client.Log.Info("Add: Synchronising %d nodes", len(nodesToSync))
-					}
-					for _, node := range nodesToSync {
-						node.Set(item, nil)
-					}
+				client.Log.Info("Replace: Synchronising %d nodes", len(nodesToSync))
+				// Write to all sync nodes unconditionally
+				repairChan := client.traceRepair(ctx, "Replace", item.Key, len(nodesToSync))
+				for _, node := range nodesToSync {
+					node.Set(item, repairChan)
 				}
+				client.events.emit(Event{Type: EVENT_REPAIR_PERFORMED, Op: "Replace", Key: item.Key, Nodes: len(nodesToSync)})
 			}
 
-			finishChan <- memcache.ErrNotStored
+			// Synchronised nodes are not counted towards the write consistency
+			finishChan <- result.err(required)
 			return
 		}
 
+		// Chunks are only referenced by a stored manifest
+		client.discardChunks(item)
+
 		// If this happened, writes to all nodes failed
 		if client.Nodes.GetHealthyNodeCount() == 0 {
 			finishChan <- ErrNoHealthyNodes
 			return
 		}
 
-		// All good
-		finishChan <- nil
+		// Was the item rejected, rather than not stored?
+		if result.rejection() != nil {
+			finishChan <- result.err(required)
+			return
+		}
+
+		finishChan <- memcache.ErrNotStored
 	}()
 
-	// Return result
-	return <-finishChan
+	// Wait for result or cancellation
+	select {
+	case err := <-finishChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Set writes the given item, unconditionally.
 func (client *Client) Set(item *Item) error {
+	return client.SetContext(context.Background(), item)
+}
+
+// SetContext is like Set, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (client *Client) SetContext(ctx context.Context, item *Item) (err error) {
+	ctx, op := client.startOperation(ctx, "Set", item.Key)
+	defer op.end(&err)
+	// Validate the key, and timestamp the write
+	item, err = client.storageItem(item)
+	if err != nil {
+		return err
+	}
+	item = item.withTimestamp(time.Now())
+
 	// Get all nodes that are marked healthy
 	nodes := client.Nodes.GetHealthyNodes()
 	nodeCount := len(nodes)
@@ -135,12 +394,26 @@ func (client *Client) Set(item *Item) error {
 		return ErrNoHealthyNodes
 	}
 
-	finishChan := make(chan (error))
+	// Bug out early if too few nodes to meet the write consistency
+	required := client.writeNodesRequired(ctx)
+	if nodeCount < required {
+		return ErrInsufficientReplicas
+	}
+
+	// Write the chunks of a long value, and the manifest in its place
+	item, err = client.chunk(ctx, item)
+	if err != nil {
+		return err
+	}
+
+	finishChan := make(chan (error), 1)
 	statusChan := make(chan (*NodeResponse), nodeCount)
 
+	nodeChan := client.traceNodes(ctx, "Set", item, nodes, statusChan)
+
 	// Concurrently write to all nodes
 	for _, node := range nodes {
-		node.Set(item, statusChan)
+		node.Set(item, nodeChan)
 	}
 
 	// Handle responses
@@ -153,9 +426,16 @@ func (client *Client) Set(item *Item) error {
 			}
 		}()
 
+		// Nodes that stored the item, and errors from nodes that failed
+		result := &writeResult{}
+
 		for ; nodeCount > 0; nodeCount-- {
-			// We actually don't care about errors, Node handles them.
-			<-statusChan
+			result.add(<-statusChan)
+		}
+
+		// Chunks are only referenced by a stored manifest
+		if result.acks == 0 {
+			client.discardChunks(item)
 		}
 
 		// If this happened, writes to all nodes failed
@@ -164,16 +444,37 @@ func (client *Client) Set(item *Item) error {
 			return
 		}
 
-		finishChan <- nil
+		// Did enough nodes acknowledge the write, without any rejecting it?
+		finishChan <- result.err(required)
 	}()
 
-	// Wait for final response and return
-	return <-finishChan
+	// Wait for final response or cancellation
+	select {
+	case err := <-finishChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Get gets the item for the given key. ErrCacheMiss is returned for a memcache cache miss.
 // The key must be at most 250 bytes in length.
 func (client *Client) Get(key string) (*Item, error) {
+	return client.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (client *Client) GetContext(ctx context.Context, key string) (item *Item, err error) {
+	ctx, op := client.startOperation(ctx, "Get", key)
+	defer op.end(&err)
+	defer client.observeLookup("Get", &err)
+	// Validate the key
+	requestedKey := key
+	key, err = client.storageKey(key)
+	if err != nil {
+		return nil, err
+	}
+
 	// Get all nodes that are marked healthy
 	nodes := client.Nodes.GetHealthyNodes()
 	nodeCount := len(nodes)
@@ -183,32 +484,274 @@ func (client *Client) Get(key string) (*Item, error) {
 		return nil, ErrNoHealthyNodes
 	}
 
-	// If there are more than 2 nodes
-	if nodeCount > 2 {
-		// Reduce to Ceil(n/2) nodes
-		nodesToRead := nodeCount / 2
-		if nodesToRead*2 < nodeCount {
-			nodesToRead += 1
-		}
-		for k := range nodes {
-			if len(nodes) <= nodesToRead {
-				break
+	// Bug out early if too few nodes to meet the read consistency
+	required := client.readNodesRequired(ctx)
+	if nodeCount < required {
+		return nil, ErrInsufficientReplicas
+	}
+
+	// Reduce to the subset of nodes to read from
+	nodes = selectReadNodes(nodes, required)
+	nodeCount = len(nodes)
+
+	finishChan := make(chan (*NodeResponse), 1)
+	statusChan := make(chan (*NodeResponse), nodeCount)
+
+	nodeChan := client.traceNodes(ctx, "Get", nil, nodes, statusChan)
+
+	// Concurrently read from nodes
+	for _, node := range nodes {
+		node.Get(key, nodeChan)
+	}
+
+	// Handle responses
+	go func() {
+		// Panic handler
+		defer func() {
+			r := recover()
+			if r != nil {
+				finishChan <- NewNodeResponse(nil, nil, ErrUnknown)
 			}
-			delete(nodes, k)
+		}()
+
+		// Get response from all nodes
+		result := newReconciliation(key)
+		for ; nodeCount > 0; nodeCount-- {
+			result.add(<-statusChan)
+		}
+
+		// Resync nodes that missed or returned an older item
+		item := result.newest()
+		result.repair(client.Log, client.events, "Get", item, func(nodeCount int) chan (*NodeResponse) {
+			return client.traceRepair(ctx, "Get", key, nodeCount)
+		})
+
+		// Not enough nodes agreed, nodes are still synchronised
+		if result.agreed(item) < required {
+			finishChan <- NewNodeResponse(nil, nil, ErrInsufficientReplicas)
+			return
+		}
+
+		// Not found, or deleted
+		if item == nil || item.tombstone {
+			finishChan <- NewNodeResponse(nil, nil, memcache.ErrCacheMiss)
+			return
+		}
+
+		// Return Item
+		finishChan <- NewNodeResponse(nil, item, nil)
+	}()
+
+	// Wait for aggregate response or cancellation
+	select {
+	case res := <-finishChan:
+		item, err := res.Item, res.Error
+		if err == nil && item.chunked {
+			item, err = client.unchunk(ctx, item)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return item.withKey(requestedKey), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// GetMulti is a batch version of Get. The returned map from keys to items may have fewer elements than the input slice,
+// due to memcache cache misses. Each key must be at most 250 bytes in length.
+func (client *Client) GetMulti(keys []string) (map[string]*Item, error) {
+	return client.GetMultiContext(context.Background(), keys)
+}
+
+// GetMultiContext is like GetMulti, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (client *Client) GetMultiContext(ctx context.Context, keys []string) (items map[string]*Item, err error) {
+	ctx, op := client.startOperation(ctx, "GetMulti", "")
+	defer op.end(&err)
+	op.setAttribute("memcacheha.keys", len(keys))
+	// Validate the keys before reading any, recording the keys requested for each key read once
+	requestedKeys := map[string][]string{}
+	var storageKeys []string
+	for _, key := range keys {
+		storageKey, err := client.storageKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if _, found := requestedKeys[storageKey]; !found {
+			storageKeys = append(storageKeys, storageKey)
 		}
-		nodeCount = len(nodes)
+		requestedKeys[storageKey] = append(requestedKeys[storageKey], key)
 	}
+	keys = storageKeys
 
-	finishChan := make(chan (*NodeResponse))
+	// Get all nodes that are marked healthy
+	nodes := client.Nodes.GetHealthyNodes()
+
+	// Bug out early if no nodes
+	if len(nodes) == 0 {
+		return nil, ErrNoHealthyNodes
+	}
+
+	// Bug out early if too few nodes to meet the read consistency
+	required := client.readNodesRequired(ctx)
+	if len(nodes) < required {
+		return nil, ErrInsufficientReplicas
+	}
+
+	// Reduce to the subset of nodes to read from
+	nodes = selectReadNodes(nodes, required)
+	nodeCount := len(nodes)
+
+	finishChan := make(chan (*NodeResponse), 1)
 	statusChan := make(chan (*NodeResponse), nodeCount)
 
+	nodeChan := client.traceNodes(ctx, "GetMulti", nil, nodes, statusChan)
+
 	// Concurrently read from nodes
 	for _, node := range nodes {
-		node.Get(key, statusChan)
+		node.GetMulti(keys, nodeChan)
 	}
 
-	// These are the nodes to sync to if we get some ErrCacheMiss from requests
-	var nodesToSync []*Node
+	// Handle responses
+	go func() {
+		// Panic handler
+		defer func() {
+			r := recover()
+			if r != nil {
+				finishChan <- NewNodeResponse(nil, nil, ErrUnknown)
+			}
+		}()
+
+		// Responses for each key
+		results := map[string]*reconciliation{}
+		for _, key := range keys {
+			results[key] = newReconciliation(key)
+		}
+
+		// Number of nodes that responded, and the last error from a node that did not
+		responded := 0
+		var nodeErr error
+
+		// Get response from all nodes
+		for ; nodeCount > 0; nodeCount-- {
+			response := <-statusChan
+			if response.Error != nil {
+				nodeErr = response.Error
+				continue
+			}
+			responded++
+			for key, result := range results {
+				item, found := response.Items[key]
+				if !found {
+					result.add(NewNodeResponse(response.Node, nil, memcache.ErrCacheMiss))
+					continue
+				}
+				result.add(NewNodeResponse(response.Node, item, nil))
+			}
+		}
+
+		// No items can be returned if no node responded
+		if responded == 0 {
+			finishChan <- NewNodeResponse(nil, nil, nodeErr)
+			return
+		}
+
+		response := NewNodeResponse(nil, nil, nil)
+		response.Items = map[string]*Item{}
+		if responded < required {
+			response.Error = ErrInsufficientReplicas
+		}
+
+		for key, result := range results {
+			// Resync nodes that missed or returned an older item
+			item := result.newest()
+			result.repair(client.Log, client.events, "GetMulti", item, func(nodeCount int) chan (*NodeResponse) {
+				return client.traceRepair(ctx, "GetMulti", key, nodeCount)
+			})
+
+			// Leave out items that not enough nodes agreed on, nodes are still synchronised
+			if result.agreed(item) < required {
+				response.Error = ErrInsufficientReplicas
+				continue
+			}
+			if item != nil && !item.tombstone {
+				response.Items[key] = item
+			}
+		}
+
+		// Return Items
+		finishChan <- response
+	}()
+
+	// Wait for aggregate response or cancellation
+	select {
+	case res := <-finishChan:
+		// Items are returned alongside ErrInsufficientReplicas for keys that met the read consistency
+		if res.Items == nil {
+			return nil, res.Error
+		}
+		items, err := client.unchunkMulti(ctx, res.Items)
+		if items == nil {
+			return nil, err
+		}
+		if err == nil {
+			err = res.Error
+		}
+		requestedItems := map[string]*Item{}
+		for key, item := range items {
+			for _, requestedKey := range requestedKeys[key] {
+				requestedItems[requestedKey] = item.withKey(requestedKey)
+			}
+		}
+		client.Metrics.AddLookups("GetMulti", len(items), len(requestedKeys)-len(items))
+		return requestedItems, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// GetForUpdate gets the item for the given key from all healthy nodes, recording the CAS id returned by each node so that
+// the item can subsequently be passed to CompareAndSwap. ErrCacheMiss is returned for a memcache cache miss on all nodes.
+// No synchronisation is performed, nodes missing the item are synchronised by CompareAndSwap.
+func (client *Client) GetForUpdate(key string) (*Item, error) {
+	return client.GetForUpdateContext(context.Background(), key)
+}
+
+// GetForUpdateContext is like GetForUpdate, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (client *Client) GetForUpdateContext(ctx context.Context, key string) (item *Item, err error) {
+	ctx, op := client.startOperation(ctx, "GetForUpdate", key)
+	defer op.end(&err)
+	defer client.observeLookup("GetForUpdate", &err)
+	return client.getForUpdate(ctx, key, pickNewest)
+}
+
+// getForUpdate implements GetForUpdate, using pick to reconcile the items returned by different nodes.
+func (client *Client) getForUpdate(ctx context.Context, key string, pick func(item, candidate *Item) *Item) (*Item, error) {
+	// Validate the key
+	requestedKey := key
+	key, err := client.storageKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get all nodes that are marked healthy
+	nodes := client.Nodes.GetHealthyNodes()
+	nodeCount := len(nodes)
+
+	// Bug out early if no nodes
+	if nodeCount == 0 {
+		return nil, ErrNoHealthyNodes
+	}
+
+	finishChan := make(chan (*NodeResponse), 1)
+	statusChan := make(chan (*NodeResponse), nodeCount)
+
+	nodeChan := client.traceNodes(ctx, "Get", nil, nodes, statusChan)
+
+	// Concurrently read from all nodes
+	for _, node := range nodes {
+		node.Get(key, nodeChan)
+	}
 
 	// Handle responses
 	go func() {
@@ -223,63 +766,486 @@ func (client *Client) Get(key string) (*Item, error) {
 		// Placeholder for result
 		var item *Item
 
+		// CAS ids from all nodes returning the item
+		casItems := map[string]*memcache.Item{}
+
 		// Get response from all nodes
 		for ; nodeCount > 0; nodeCount-- {
 			response := <-statusChan
-			if response.Error == memcache.ErrCacheMiss {
-				nodesToSync = append(nodesToSync, response.Node)
-			}
 			if response.Error == nil && response.Item != nil {
-				item = response.Item
+				if item == nil {
+					item = response.Item
+				} else {
+					item = pick(item, response.Item)
+				}
+				for endpoint, casItem := range response.Item.casItems {
+					casItems[endpoint] = casItem
+				}
 			}
 		}
 
-		// Did we find an item from any node?
-		if item != nil {
+		// Not found, or deleted
+		if item == nil || item.tombstone {
+			finishChan <- NewNodeResponse(nil, nil, memcache.ErrCacheMiss)
+			return
+		}
+
+		item.casItems = casItems
+		finishChan <- NewNodeResponse(nil, item, nil)
+	}()
+
+	// Wait for aggregate response or cancellation
+	select {
+	case res := <-finishChan:
+		item, err := res.Item, res.Error
+		if err == nil && item.chunked {
+			item, err = client.unchunk(ctx, item)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return item.withKey(requestedKey), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// CompareAndSwap writes the given item that was previously returned by GetForUpdate, on every healthy node that returned
+// it, provided it has not been modified on that node since. The swap succeeds if more nodes succeed than report
+// ErrCASConflict, in which case the nodes that conflicted, missed the item, or did not return it to GetForUpdate are
+// synchronised with the new value. Otherwise ErrCASConflict is returned, and the nodes that succeeded are rolled back to
+// the item they returned to GetForUpdate, unless it was modified again since. ErrCacheMiss is returned if the item was
+// evicted or deleted from all nodes in the meantime.
+func (client *Client) CompareAndSwap(item *Item) error {
+	return client.CompareAndSwapContext(context.Background(), item)
+}
+
+// CompareAndSwapContext is like CompareAndSwap, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (client *Client) CompareAndSwapContext(ctx context.Context, item *Item) (err error) {
+	ctx, op := client.startOperation(ctx, "CompareAndSwap", item.Key)
+	defer op.end(&err)
+	if len(item.casItems) == 0 {
+		return ErrNoCASID
+	}
+
+	// Validate the key, and timestamp the write
+	item, err = client.storageItem(item)
+	if err != nil {
+		return err
+	}
+	item = item.withTimestamp(time.Now())
+
+	// Get all nodes that are marked healthy
+	nodes := client.Nodes.GetHealthyNodes()
+
+	// Bug out early if no nodes
+	if len(nodes) == 0 {
+		return ErrNoHealthyNodes
+	}
+
+	// Bug out early if too few nodes to meet the write consistency
+	required := client.writeNodesRequired(ctx)
+	if len(nodes) < required {
+		return ErrInsufficientReplicas
+	}
+
+	// Write the chunks of a long value, and swap the manifest in its place
+	item, err = client.chunk(ctx, item)
+	if err != nil {
+		return err
+	}
+
+	// These are the nodes to sync to if the swap succeeds
+	var nodesToSync []*Node
+
+	// Split nodes into those with and without a CAS id
+	for endpoint, node := range nodes {
+		if _, found := item.casItems[endpoint]; !found {
+			nodesToSync = append(nodesToSync, node)
+			delete(nodes, endpoint)
+		}
+	}
+	nodeCount := len(nodes)
+
+	finishChan := make(chan (error), 1)
+	statusChan := make(chan (*NodeResponse), nodeCount)
+
+	nodeChan := client.traceNodes(ctx, "CompareAndSwap", item, nodes, statusChan)
+
+	// Concurrently swap on all nodes with a CAS id
+	for _, node := range nodes {
+		node.CompareAndSwap(item, nodeChan)
+	}
+
+	// Handle responses
+	go func() {
+		// Panic handler
+		defer func() {
+			r := recover()
+			if r != nil {
+				finishChan <- ErrUnknown
+			}
+		}()
+
+		// Nodes that swapped the item, and errors from nodes that failed
+		result := &writeResult{}
+		conflicts, misses := 0, 0
+		var swappedNodes []*Node
+
+		for ; nodeCount > 0; nodeCount-- {
+			response := <-statusChan
+			switch response.Error {
+			case nil:
+				swappedNodes = append(swappedNodes, response.Node)
+			case memcache.ErrCASConflict:
+				conflicts++
+				nodesToSync = append(nodesToSync, response.Node)
+			case memcache.ErrCacheMiss:
+				misses++
+				nodesToSync = append(nodesToSync, response.Node)
+			}
+			result.add(response, memcache.ErrCASConflict, memcache.ErrCacheMiss)
+		}
+
+		// Did the swap win on the nodes holding the item?
+		if result.acks > 0 && result.acks > conflicts {
 			if len(nodesToSync) > 0 {
-				if item.Expiration != nil {
-					client.Log.Info("Get: Synchronising %d nodes with %s expiry", len(nodesToSync), *item.Expiration)
-				} else {
-					client.Log.Info("Get: Synchronising %d nodes", len(nodesToSync))
-				}
-				// Resync by writing to missing nodes
+				client.Log.Info("CompareAndSwap: Synchronising %d nodes", len(nodesToSync))
+				repairChan := client.traceRepair(ctx, "CompareAndSwap", item.Key, len(nodesToSync))
 				for _, node := range nodesToSync {
-					node.Set(item, nil)
+					node.Set(item, repairChan)
 				}
+				client.events.emit(Event{Type: EVENT_REPAIR_PERFORMED, Op: "CompareAndSwap", Key: item.Key, Nodes: len(nodesToSync)})
 			}
 
-			// Return Item
-			finishChan <- NewNodeResponse(nil, item, nil)
+			// Synchronised nodes are not counted towards the write consistency
+			finishChan <- result.err(required)
+			return
+		}
+
+		// The swap lost, so roll back the nodes that swapped the item, even if ctx is done
+		stored := len(swappedNodes) > 0
+		if stored && client.rollBack(context.WithoutCancel(ctx), item, swappedNodes) {
+			stored = false
+		}
+
+		// Chunks are only referenced by a stored manifest
+		if !stored {
+			client.discardChunks(item)
+		}
+
+		if conflicts > 0 {
+			finishChan <- memcache.ErrCASConflict
+			return
+		}
+
+		// Was the item rejected, rather than missing?
+		if result.rejection() != nil {
+			finishChan <- result.err(required)
+			return
+		}
+
+		if misses > 0 {
+			finishChan <- memcache.ErrCacheMiss
 			return
 		}
 
-		// Not found
-		finishChan <- NewNodeResponse(nil, nil, memcache.ErrCacheMiss)
+		// If this happened, writes to all nodes failed
+		if client.Nodes.GetHealthyNodeCount() == 0 {
+			finishChan <- ErrNoHealthyNodes
+			return
+		}
+
+		finishChan <- result.err(required)
 	}()
 
-	// Wait for aggregate response
-	res := <-finishChan
+	select {
+	case err := <-finishChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rollBack restores the items read by GetForUpdate on the given nodes that swapped the given item, when the swap lost.
+// True is returned if no node still holds the swapped item.
+func (client *Client) rollBack(ctx context.Context, item *Item, swappedNodes []*Node) bool {
+	client.Log.Info("CompareAndSwap: Rolling back %d nodes", len(swappedNodes))
+	repairChan := client.traceRepair(ctx, "CompareAndSwap", item.Key, len(swappedNodes))
+	statusChan := make(chan (*NodeResponse), len(swappedNodes))
+	for _, node := range swappedNodes {
+		node.RollBack(item, statusChan)
+	}
 
-	return res.Item, res.Error
+	// Nodes that swapped the item again since no longer hold it
+	rolledBack := true
+	for i := 0; i < len(swappedNodes); i++ {
+		response := <-statusChan
+		if response.Error != nil && response.Error != memcache.ErrCASConflict && response.Error != memcache.ErrCacheMiss {
+			rolledBack = false
+		}
+		if repairChan != nil {
+			repairChan <- response
+		}
+	}
+	client.events.emit(Event{Type: EVENT_REPAIR_PERFORMED, Op: "CompareAndSwap", Key: item.Key, Nodes: len(swappedNodes)})
+	return rolledBack
+}
+
+// Append appends the value of the given item to the existing value for its key on all nodes, leaving the existing
+// expiry and flags intact. ErrNotStored is returned if the key does not exist on any node. Nodes missing the key are
+// synchronised with the new value.
+func (client *Client) Append(item *Item) error {
+	return client.AppendContext(context.Background(), item)
+}
+
+// AppendContext is like Append, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (client *Client) AppendContext(ctx context.Context, item *Item) (err error) {
+	ctx, op := client.startOperation(ctx, "Append", item.Key)
+	defer op.end(&err)
+	return client.appendPrepend(ctx, item, func(value []byte) []byte {
+		out := make([]byte, 0, len(value)+len(item.Value))
+		out = append(out, value...)
+		return append(out, item.Value...)
+	})
+}
+
+// Prepend prepends the value of the given item to the existing value for its key on all nodes, leaving the existing
+// expiry and flags intact. ErrNotStored is returned if the key does not exist on any node. Nodes missing the key are
+// synchronised with the new value.
+func (client *Client) Prepend(item *Item) error {
+	return client.PrependContext(context.Background(), item)
+}
+
+// PrependContext is like Prepend, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (client *Client) PrependContext(ctx context.Context, item *Item) (err error) {
+	ctx, op := client.startOperation(ctx, "Prepend", item.Key)
+	defer op.end(&err)
+	return client.appendPrepend(ctx, item, func(value []byte) []byte {
+		out := make([]byte, 0, len(value)+len(item.Value))
+		out = append(out, item.Value...)
+		return append(out, value...)
+	})
+}
+
+// appendPrepend rewrites the value for the key of the given item with op. The memcache append and prepend commands
+// are not used, as prepend would corrupt the memcacheha header.
+func (client *Client) appendPrepend(ctx context.Context, item *Item, op func(value []byte) []byte) error {
+	_, err := client.modify(ctx, item.Key, pickNewest, func(existing *Item) error {
+		existing.Value = op(existing.Value)
+		return nil
+	})
+	if err == memcache.ErrCacheMiss {
+		return memcache.ErrNotStored
+	}
+	return err
+}
+
+// Increment atomically increments key by delta on all nodes. The return value is the new value after being incremented
+// or an error. If the value didn't exist in memcached the error is ErrCacheMiss. The value in memcached must be a decimal
+// number, or an error will be returned. On 64-bit overflow, the new value wraps around. Where nodes disagree, the
+// highest value wins and all nodes are synchronised to the new value.
+func (client *Client) Increment(key string, delta uint64) (uint64, error) {
+	return client.IncrementContext(context.Background(), key, delta)
+}
+
+// IncrementContext is like Increment, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (client *Client) IncrementContext(ctx context.Context, key string, delta uint64) (value uint64, err error) {
+	ctx, op := client.startOperation(ctx, "Increment", key)
+	defer op.end(&err)
+	return client.incrDecr(ctx, key, func(value uint64) uint64 {
+		return value + delta
+	})
+}
+
+// Decrement atomically decrements key by delta on all nodes. The return value is the new value after being decremented
+// or an error. If the value didn't exist in memcached the error is ErrCacheMiss. The value in memcached must be a decimal
+// number, or an error will be returned. On underflow, the new value is capped at zero and does not wrap around. Where
+// nodes disagree, the highest value wins and all nodes are synchronised to the new value.
+func (client *Client) Decrement(key string, delta uint64) (uint64, error) {
+	return client.DecrementContext(context.Background(), key, delta)
+}
+
+// DecrementContext is like Decrement, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (client *Client) DecrementContext(ctx context.Context, key string, delta uint64) (value uint64, err error) {
+	ctx, op := client.startOperation(ctx, "Decrement", key)
+	defer op.end(&err)
+	return client.incrDecr(ctx, key, func(value uint64) uint64 {
+		if delta > value {
+			return 0
+		}
+		return value - delta
+	})
+}
+
+func (client *Client) incrDecr(ctx context.Context, key string, op func(value uint64) uint64) (uint64, error) {
+	item, err := client.modify(ctx, key, pickCounter, func(item *Item) error {
+		value, err := strconv.ParseUint(string(item.Value), 10, 64)
+		if err != nil {
+			return ErrNonNumericValue
+		}
+		item.Value = []byte(strconv.FormatUint(op(value), 10))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(item.Value), 10, 64)
+}
+
+// pickNewest reconciles items from different nodes, the newest item wins
+func pickNewest(item, candidate *Item) *Item {
+	if item.newerThan(candidate) {
+		return item
+	}
+	return candidate
+}
+
+// pickCounter reconciles counter items from different nodes, the highest value wins
+func pickCounter(item, candidate *Item) *Item {
+	if item.tombstone || candidate.tombstone {
+		return pickNewest(item, candidate)
+	}
+	value, err := strconv.ParseUint(string(item.Value), 10, 64)
+	if err != nil {
+		return candidate
+	}
+	candidateValue, err := strconv.ParseUint(string(candidate.Value), 10, 64)
+	if err != nil || candidateValue <= value {
+		return item
+	}
+	return candidate
+}
+
+// modify performs a read-modify-write of the item with the given key using GetForUpdate and CompareAndSwap, retrying
+// up to CASRetries times on ErrCASConflict. The write is recorded in the operation history of the item, so a retry after
+// a swap that lost, but was built on by another client before it was rolled back, swaps the item as read instead of
+// applying fn again. Items the nodes disagree on are read again until they agree, or stop changing.
+func (client *Client) modify(ctx context.Context, key string, pick func(item, candidate *Item) *Item, fn func(item *Item) error) (*Item, error) {
+	// Bug out early if too few nodes to meet the write consistency
+	if client.Nodes.GetHealthyNodeCount() < client.writeNodesRequired(ctx) {
+		return nil, ErrInsufficientReplicas
+	}
+
+	binOperation := make([]byte, 8)
+	if _, err := rand.Read(binOperation); err != nil {
+		return nil, err
+	}
+	operation := binary.BigEndian.Uint64(binOperation)
+
+	var previous *Item
+	for i := 0; i < client.CASRetries; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		item, err := client.getForUpdate(ctx, key, pick)
+		if err != nil {
+			return nil, err
+		}
+
+		// Nodes holding different items may be part way through a swap that will be rolled back, which must not be
+		// built on, so the item is only modified once the nodes agree, or hold the same items as when last read
+		if !client.agreed(item) && !unchanged(previous, item) {
+			client.Log.Debug("Modify: Nodes disagree on %s, retrying", key)
+			previous = item
+			continue
+		}
+		if item.applied(operation) {
+			// The operation is only written if all nodes hold it, otherwise swap the item as it is
+			if client.agreed(item) {
+				return item, nil
+			}
+			client.Log.Debug("Modify: Operation on %s partially applied", key)
+		} else {
+			err = fn(item)
+			if err != nil {
+				return nil, err
+			}
+			item.addOperation(operation)
+		}
+		err = client.CompareAndSwapContext(ctx, item)
+		if err == memcache.ErrCASConflict {
+			client.Log.Debug("Modify: CAS conflict on %s, retrying", key)
+			continue
+		}
+		return item, err
+	}
+	return nil, memcache.ErrCASConflict
+}
+
+// agreed returns true if all nodes that returned the given item to GetForUpdate hold the same write
+func (client *Client) agreed(item *Item) bool {
+	for _, casItem := range item.casItems {
+		existing, err := decodeItem(casItem, &client.Encoding)
+		if err != nil || !existing.Timestamp.Equal(item.Timestamp) {
+			return false
+		}
+	}
+	return true
+}
+
+// unchanged returns true if the given items were read from the same nodes by GetForUpdate, and none have been written
+// in between
+func unchanged(previous, item *Item) bool {
+	if previous == nil || len(previous.casItems) != len(item.casItems) {
+		return false
+	}
+	for endpoint, casItem := range item.casItems {
+		previousItem, found := previous.casItems[endpoint]
+		if !found || previousItem.CasID != casItem.CasID {
+			return false
+		}
+	}
+	return true
 }
 
 // Delete deletes the item with the provided key. The error ErrCacheMiss is returned if the item didn't already exist in the cache.
+// If TombstoneTTL is set, the item is replaced with a tombstone expiring after TombstoneTTL, which prevents Get from
+// synchronising an older value from a node that missed the delete.
 func (client *Client) Delete(key string) error {
+	return client.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Delete, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (client *Client) DeleteContext(ctx context.Context, key string) (err error) {
+	ctx, op := client.startOperation(ctx, "Delete", key)
+	defer op.end(&err)
+	// Validate the key
+	key, err = client.storageKey(key)
+	if err != nil {
+		return err
+	}
+
 	// Get all nodes that are marked healthy
 	nodes := client.Nodes.GetHealthyNodes()
 	nodeCount := len(nodes)
 
 	// Bug out early if no nodes
-	if len(nodes) == 0 {
+	if nodeCount == 0 {
 		return ErrNoHealthyNodes
 	}
 
-	finishChan := make(chan (error))
+	// Bug out early if too few nodes to meet the write consistency
+	required := client.writeNodesRequired(ctx)
+	if nodeCount < required {
+		return ErrInsufficientReplicas
+	}
+
+	finishChan := make(chan (error), 1)
 	statusChan := make(chan (*NodeResponse), nodeCount)
 
-	// Concurrently delete from all nodes
+	// Concurrently delete from all nodes, replacing items with tombstones if configured
+	var tombstone *Item
+	if client.TombstoneTTL > 0 && !client.Encoding.isRaw(key) {
+		tombstone = newTombstone(key, time.Now().Add(client.TombstoneTTL))
+	}
+	nodeChan := client.traceNodes(ctx, "Delete", tombstone, nodes, statusChan)
 	for _, node := range nodes {
-		node.Delete(key, statusChan)
+		if tombstone != nil {
+			node.Tombstone(tombstone, nodeChan)
+		} else {
+			node.Delete(key, nodeChan)
+		}
 	}
 
 	// If any node returns ErrCacheMiss return this instead.
@@ -295,11 +1261,16 @@ func (client *Client) Delete(key string) error {
 			}
 		}()
 
+		// Nodes that responded with or without the key, and errors from nodes that failed
+		result := &writeResult{}
+
 		for ; nodeCount > 0; nodeCount-- {
 			response := <-statusChan
 			if response.Error == memcache.ErrCacheMiss {
 				errToReturn = memcache.ErrCacheMiss
+				result.acks++
 			}
+			result.add(response, memcache.ErrCacheMiss)
 		}
 
 		// If this happened, writes to all nodes failed
@@ -308,31 +1279,63 @@ func (client *Client) Delete(key string) error {
 			return
 		}
 
+		// Did enough nodes acknowledge the write, without any rejecting it?
+		if err := result.err(required); err != nil {
+			finishChan <- err
+			return
+		}
+
 		finishChan <- errToReturn
 	}()
 
-	return <-finishChan
+	select {
+	case err := <-finishChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Touch updates the expiry for the given key. The seconds parameter is either a Unix timestamp or,
 // if seconds is less than 1 month, the number of seconds into the future at which time the item will expire.
 // ErrCacheMiss is returned if the key is not in the cache. The key must be at most 250 bytes in length.
 func (client *Client) Touch(key string, seconds int32) error {
+	return client.TouchContext(context.Background(), key, seconds)
+}
+
+// TouchContext is like Touch, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (client *Client) TouchContext(ctx context.Context, key string, seconds int32) (err error) {
+	ctx, op := client.startOperation(ctx, "Touch", key)
+	defer op.end(&err)
+	// Validate the key
+	key, err = client.storageKey(key)
+	if err != nil {
+		return err
+	}
+
 	// Get all nodes that are marked healthy
 	nodes := client.Nodes.GetHealthyNodes()
 	nodeCount := len(nodes)
 
 	// Bug out early if no nodes
-	if len(nodes) == 0 {
+	if nodeCount == 0 {
 		return ErrNoHealthyNodes
 	}
 
-	finishChan := make(chan (error))
+	// Bug out early if too few nodes to meet the write consistency
+	required := client.writeNodesRequired(ctx)
+	if nodeCount < required {
+		return ErrInsufficientReplicas
+	}
+
+	finishChan := make(chan (error), 1)
 	statusChan := make(chan (*NodeResponse), nodeCount)
 
+	nodeChan := client.traceNodes(ctx, "Touch", nil, nodes, statusChan)
+
 	// Concurrently delete from all nodes
 	for _, node := range nodes {
-		node.Touch(key, seconds, statusChan)
+		node.Touch(key, seconds, nodeChan)
 	}
 
 	// If any node returns ErrCacheMiss return this instead.
@@ -348,11 +1351,16 @@ func (client *Client) Touch(key string, seconds int32) error {
 			}
 		}()
 
+		// Nodes that responded with or without the key, and errors from nodes that failed
+		result := &writeResult{}
+
 		for ; nodeCount > 0; nodeCount-- {
 			response := <-statusChan
 			if response.Error == memcache.ErrCacheMiss {
 				errToReturn = memcache.ErrCacheMiss
+				result.acks++
 			}
+			result.add(response, memcache.ErrCacheMiss)
 		}
 
 		// If this happened, writes to all nodes failed
@@ -361,10 +1369,45 @@ func (client *Client) Touch(key string, seconds int32) error {
 			return
 		}
 
+		// Did enough nodes acknowledge the write, without any rejecting it?
+		if err := result.err(required); err != nil {
+			finishChan <- err
+			return
+		}
+
 		finishChan <- errToReturn
 	}()
 
-	return <-finishChan
+	select {
+	case err := <-finishChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// selectReadNodes reduces the given healthy nodes to the given count, or if count is 0, to Ceil(n/2) nodes if there are
+// more than 2.
+func selectReadNodes(nodes map[string]*Node, count int) map[string]*Node {
+	nodeCount := len(nodes)
+	nodesToRead := count
+	if nodesToRead == 0 {
+		if nodeCount <= 2 {
+			return nodes
+		}
+		nodesToRead = nodeCount / 2
+		if nodesToRead*2 < nodeCount {
+			nodesToRead += 1
+		}
+	}
+
+	for k := range nodes {
+		if len(nodes) <= nodesToRead {
+			break
+		}
+		delete(nodes, k)
+	}
+	return nodes
 }
 
 // Start the Client client. This should be called before any operations are called.
@@ -379,19 +1422,27 @@ func (client *Client) Start() error {
 
 // WaitForNodes waits for at least one available node, timing out on the deadline with ErrNoHealthyNodes
 func (client *Client) WaitForNodes(deadline time.Time) error {
-	startedChan := make(chan (error))
-	go func() {
-		for !time.Now().After(deadline) {
-			if client.Nodes.GetHealthyNodeCount() > 0 {
-				startedChan <- nil
-				return
-			}
-			time.Sleep(time.Second / 10)
-		}
-		startedChan <- ErrNoHealthyNodes
-	}()
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	if client.WaitForNodesContext(ctx) != nil {
+		return ErrNoHealthyNodes
+	}
+	return nil
+}
 
-	return <-startedChan
+// WaitForNodesContext waits for at least one available node, returning ctx.Err() if ctx is done first
+func (client *Client) WaitForNodesContext(ctx context.Context) error {
+	for {
+		if client.Nodes.GetHealthyNodeCount() > 0 {
+			return nil
+		}
+		select {
+		case <-time.After(time.Second / 10):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
 func (client *Client) runloop() {
@@ -406,12 +1457,12 @@ func (client *Client) runloop() {
 		case <-timerChannel:
 			now := time.Now()
 
-			if lastGetNodes.Add(GET_NODES_PERIOD).Before(now) {
+			if lastGetNodes.Add(client.GetNodesPeriod).Before(now) {
 				client.GetNodes()
 				lastGetNodes = time.Now()
 			}
 
-			if lastHealthCheck.Add(HEALTHCHECK_PERIOD).Before(now) {
+			if lastHealthCheck.Add(client.HealthCheckPeriod).Before(now) {
 				err := client.HealthCheck()
 				if err != nil {
 					client.Log.Warn("HealthCheck returned an error: %s", err)
@@ -439,6 +1490,7 @@ func (client *Client) GetNodes() {
 		nodes, err := source.GetNodes()
 		if err != nil {
 			client.Log.Error("GetNodes: Source Error: %s", err)
+			client.events.emit(Event{Type: EVENT_SOURCE_ERROR, Err: err})
 			return
 		}
 
@@ -448,7 +1500,12 @@ func (client *Client) GetNodes() {
 			if !client.Nodes.Exists(nodeAddr) {
 				client.Log.Info("GetNodes: Node Added %s", nodeAddr)
 				node := NewNode(client.Log, nodeAddr, client.Timeout)
+				node.Encoding = &client.Encoding
+				node.events = client.events
+				node.metrics = client.Metrics
+				node.tombstones = client.TombstoneTTL > 0
 				client.Nodes.Add(node)
+				client.events.emit(Event{Type: EVENT_NODE_ADDED, Endpoint: nodeAddr})
 				ok, err := node.HealthCheck()
 				if err != nil {
 					client.Log.Warn("GetNodes: Initial HealthCheck for Node %s returned an error: %s", nodeAddr, err)
@@ -461,17 +1518,18 @@ func (client *Client) GetNodes() {
 	}
 
 	// Removed nodes
-	for nodeAddr := range client.Nodes.Nodes {
+	for nodeAddr := range client.Nodes.GetNodes() {
 		if _, found := incomingNodes[nodeAddr]; !found {
 			client.Log.Info("GetNodes: Node Removed %s", nodeAddr)
-			delete(client.Nodes.Nodes, nodeAddr)
+			client.Nodes.Remove(nodeAddr)
+			client.events.emit(Event{Type: EVENT_NODE_REMOVED, Endpoint: nodeAddr})
 		}
 	}
 }
 
 // HealthCheck performs a healthcheck on all nodes.
 func (client *Client) HealthCheck() error {
-	for _, node := range client.Nodes.Nodes {
+	for _, node := range client.Nodes.GetNodes() {
 		_, err := node.HealthCheck()
 		if err != nil {
 			return err
@@ -0,0 +1,427 @@
+package memcacheha
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// writeNode writes the given item to the node of the given server only, as another client would
+func writeNode(t *testing.T, client *Client, server *testServer, item *Item) {
+	t.Helper()
+	mcItem, err := item.encode(&client.Encoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Nodes.GetNodes()[server.endpoint()].client.Set(mcItem); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readNode returns the item stored for the given key on the given server, or nil if it does not exist
+func readNode(t *testing.T, client *Client, server *testServer, key string) *Item {
+	t.Helper()
+	value, found := server.value(key)
+	if !found {
+		return nil
+	}
+	item, err := decodeItem(&memcache.Item{Key: key, Value: value}, &client.Encoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return item
+}
+
+// waitForValues waits for the given key to hold the given value on all of the given servers, failing if it does not
+func waitForValues(t *testing.T, client *Client, servers []*testServer, key string, value string) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		synchronised := true
+		for _, server := range servers {
+			if item := readNode(t, client, server, key); item == nil || string(item.Value) != value {
+				synchronised = false
+			}
+		}
+		if synchronised {
+			return
+		}
+	}
+	for _, server := range servers {
+		if item := readNode(t, client, server, key); item == nil || string(item.Value) != value {
+			t.Errorf("expected %s on %s, got %+v", value, server.endpoint(), item)
+		}
+	}
+}
+
+func TestCompareAndSwapConflicts(t *testing.T) {
+	tests := []struct {
+		name string
+		// nodes is the number of nodes, of which conflicting are written by another client before the swap
+		nodes       int
+		conflicting int
+		expected    error
+	}{
+		{"minority conflicting", 3, 1, nil},
+		{"majority conflicting", 3, 2, memcache.ErrCASConflict},
+		{"tie", 2, 1, memcache.ErrCASConflict},
+	}
+	for _, test := range tests {
+		client, servers := newTestCluster(t, test.nodes)
+		expiration := time.Now().Add(time.Hour)
+		if err := client.Set(&Item{Key: "foo", Value: []byte("old"), Expiration: &expiration}); err != nil {
+			t.Fatal(err)
+		}
+		item, err := client.GetForUpdate("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conflicting, swapping := servers[:test.conflicting], servers[test.conflicting:]
+		for _, server := range conflicting {
+			writeNode(t, client, server, &Item{Key: "foo", Value: []byte("other"), Timestamp: time.Now()})
+		}
+
+		item.Value = []byte("new")
+		if err := client.CompareAndSwap(item); err != test.expected {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.expected, err)
+		}
+		if test.expected == nil {
+			// The conflicting nodes are synchronised with the new value
+			waitForValues(t, client, servers, "foo", "new")
+			continue
+		}
+
+		// The nodes that swapped are rolled back before CompareAndSwap returns, with their expiry
+		for _, server := range swapping {
+			restored := readNode(t, client, server, "foo")
+			if restored == nil || string(restored.Value) != "old" {
+				t.Errorf("%s: expected old to be restored on %s, got %+v", test.name, server.endpoint(), restored)
+				continue
+			}
+			if restored.Expiration == nil || restored.Expiration.UnixMilli() != expiration.UnixMilli() {
+				t.Errorf("%s: expected expiry %s, got %v", test.name, expiration, restored.Expiration)
+			}
+			if expiry := server.expiry("foo"); expiry < 3590 || expiry > 3600 {
+				t.Errorf("%s: expected memcached expiration of an hour, got %d", test.name, expiry)
+			}
+		}
+		for _, server := range conflicting {
+			if other := readNode(t, client, server, "foo"); other == nil || string(other.Value) != "other" {
+				t.Errorf("%s: expected other on %s, got %+v", test.name, server.endpoint(), other)
+			}
+		}
+
+		// Reads resolve the nodes to the newest write
+		if read, err := client.GetForUpdate("foo"); err != nil || string(read.Value) != "other" {
+			t.Errorf("%s: expected other, got %+v (%v)", test.name, read, err)
+		}
+	}
+}
+
+func TestNodeRollBackOverwritten(t *testing.T) {
+	client, servers := newTestCluster(t, 1)
+	if err := client.Set(&Item{Key: "foo", Value: []byte("old")}); err != nil {
+		t.Fatal(err)
+	}
+	item, err := client.GetForUpdate("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := client.Nodes.GetNodes()[servers[0].endpoint()]
+	item = item.withTimestamp(time.Now())
+	item.Value = []byte("new")
+	statusChan := make(chan (*NodeResponse), 1)
+	node.CompareAndSwap(item, statusChan)
+	if response := <-statusChan; response.Error != nil {
+		t.Fatal(response.Error)
+	}
+
+	// A write since the swap is not rolled back
+	writeNode(t, client, servers[0], &Item{Key: "foo", Value: []byte("other"), Timestamp: time.Now()})
+	node.RollBack(item, statusChan)
+	if response := <-statusChan; response.Error != memcache.ErrCASConflict {
+		t.Errorf("expected ErrCASConflict, got %v", response.Error)
+	}
+	if other := readNode(t, client, servers[0], "foo"); string(other.Value) != "other" {
+		t.Errorf("expected other, got %q", other.Value)
+	}
+}
+
+func TestIncrementConcurrent(t *testing.T) {
+	client, _ := newTestCluster(t, 2, WithCASRetries(100), WithTimeout(5*time.Second))
+	if err := client.Set(&Item{Key: "counter", Value: []byte("0")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Swaps that lose on one node and win on the other are rolled back, or recognised when retried, so each successful
+	// Increment is counted once
+	var successes atomic.Uint64
+	wait := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := client.Increment("counter", 1); err == nil {
+					successes.Add(1)
+				}
+			}
+		}()
+	}
+	wait.Wait()
+
+	item, err := client.GetForUpdate("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := strconv.ParseUint(string(item.Value), 10, 64); value != successes.Load() {
+		t.Errorf("expected %d, got %d", successes.Load(), value)
+	}
+}
+
+func TestAppendConcurrent(t *testing.T) {
+	client, _ := newTestCluster(t, 2, WithCASRetries(100), WithTimeout(5*time.Second))
+	if err := client.Set(&Item{Key: "log", Value: []byte{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var successes atomic.Uint64
+	wait := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for j := 0; j < 25; j++ {
+				if err := client.Append(&Item{Key: "log", Value: []byte("x")}); err == nil {
+					successes.Add(1)
+				}
+			}
+		}()
+	}
+	wait.Wait()
+
+	item, err := client.GetForUpdate("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(len(item.Value)) != successes.Load() {
+		t.Errorf("expected %d bytes, got %d", successes.Load(), len(item.Value))
+	}
+}
+
+func TestContextDone(t *testing.T) {
+	client, servers := newTestCluster(t, 2, WithTimeout(time.Second))
+	if err := client.Set(&Item{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+	cas, err := client.GetForUpdate("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	operations := map[string]func(ctx context.Context) error{
+		"Add": func(ctx context.Context) error {
+			return client.AddContext(ctx, &Item{Key: "add", Value: []byte("bar")})
+		},
+		"Replace": func(ctx context.Context) error {
+			return client.ReplaceContext(ctx, &Item{Key: "foo", Value: []byte("bar")})
+		},
+		"Set": func(ctx context.Context) error {
+			return client.SetContext(ctx, &Item{Key: "set", Value: []byte("bar")})
+		},
+		"Get": func(ctx context.Context) error {
+			_, err := client.GetContext(ctx, "foo")
+			return err
+		},
+		"GetMulti": func(ctx context.Context) error {
+			_, err := client.GetMultiContext(ctx, []string{"foo"})
+			return err
+		},
+		"GetForUpdate": func(ctx context.Context) error {
+			_, err := client.GetForUpdateContext(ctx, "foo")
+			return err
+		},
+		"CompareAndSwap": func(ctx context.Context) error { return client.CompareAndSwapContext(ctx, cas) },
+		"Append": func(ctx context.Context) error {
+			return client.AppendContext(ctx, &Item{Key: "foo", Value: []byte("x")})
+		},
+		"Prepend": func(ctx context.Context) error {
+			return client.PrependContext(ctx, &Item{Key: "foo", Value: []byte("x")})
+		},
+		"Increment": func(ctx context.Context) error {
+			_, err := client.IncrementContext(ctx, "foo", 1)
+			return err
+		},
+		"Decrement": func(ctx context.Context) error {
+			_, err := client.DecrementContext(ctx, "foo", 1)
+			return err
+		},
+		"Delete": func(ctx context.Context) error { return client.DeleteContext(ctx, "foo") },
+		"Touch":  func(ctx context.Context) error { return client.TouchContext(ctx, "foo", 60) },
+	}
+
+	// Nodes respond after the context is done, whether cancelled or expired
+	for _, server := range servers {
+		server.setDelay(100 * time.Millisecond)
+	}
+	for name, operation := range operations {
+		cancelled, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := operation(cancelled); err != context.Canceled {
+			t.Errorf("%s: expected context.Canceled, got %v", name, err)
+		}
+		expiring, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if err := operation(expiring); err != context.DeadlineExceeded {
+			t.Errorf("%s: expected context.DeadlineExceeded, got %v", name, err)
+		}
+		cancel()
+	}
+	expiring, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := New(WithLogger(testLogger{})).WaitForNodesContext(expiring); err != context.DeadlineExceeded {
+		t.Errorf("WaitForNodes: expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// Nodes are repaired after the context expires
+	time.Sleep(200 * time.Millisecond)
+	for _, server := range servers {
+		server.setDelay(0)
+	}
+	if err := client.Set(&Item{Key: "repair", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+	servers[1].remove("repair")
+	servers[1].setDelay(50 * time.Millisecond)
+	expiring, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := client.GetContext(expiring, "repair"); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	waitForValues(t, client, servers, "repair", "bar")
+}
+
+func TestGetMultiRepair(t *testing.T) {
+	client, servers := newTestCluster(t, 2)
+	for _, key := range []string{"foo", "bar", "baz"} {
+		if err := client.Set(&Item{Key: key, Value: []byte("old")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// foo is missing on one node, and bar is stale on the other
+	servers[0].remove("foo")
+	writeNode(t, client, servers[0], &Item{Key: "bar", Value: []byte("new"), Timestamp: time.Now()})
+	sets := servers[0].commands("set") + servers[1].commands("set")
+
+	items, err := client.GetMulti([]string{"foo", "bar", "baz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{"foo": "old", "bar": "new", "baz": "old"} {
+		if item := items[key]; item == nil || string(item.Value) != value {
+			t.Errorf("expected %s for %s, got %+v", value, key, item)
+		}
+	}
+
+	// Each key is synchronised on the nodes that missed it or returned an older item
+	waitForValues(t, client, servers, "foo", "old")
+	waitForValues(t, client, servers, "bar", "new")
+	waitForValues(t, client, servers, "baz", "old")
+	if repairs := servers[0].commands("set") + servers[1].commands("set") - sets; repairs != 2 {
+		t.Errorf("expected foo and bar to be written once each, got %d sets", repairs)
+	}
+}
+
+func TestAppendPrepend(t *testing.T) {
+	client, servers := newTestCluster(t, 2)
+	expiration := time.Now().Add(time.Hour)
+	if err := client.Set(&Item{Key: "foo", Value: []byte("bar"), Flags: 42, Expiration: &expiration}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Append(&Item{Key: "foo", Value: []byte(">")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Prepend(&Item{Key: "foo", Value: []byte("<")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The value is rewritten within the header, keeping the flags and expiry
+	if item, err := client.Get("foo"); err != nil || string(item.Value) != "<bar>" || item.Flags != 42 {
+		t.Fatalf("expected <bar> with flags, got %+v (%v)", item, err)
+	}
+	for _, server := range servers {
+		item := readNode(t, client, server, "foo")
+		if item == nil || string(item.Value) != "<bar>" {
+			t.Fatalf("expected <bar> on %s, got %+v", server.endpoint(), item)
+		}
+		if item.Expiration == nil || item.Expiration.UnixMilli() != expiration.UnixMilli() {
+			t.Errorf("expected expiry %s on %s, got %v", expiration, server.endpoint(), item.Expiration)
+		}
+	}
+
+	// A node missing the key is written the new value
+	servers[1].remove("foo")
+	if err := client.Append(&Item{Key: "foo", Value: []byte("!")}); err != nil {
+		t.Fatal(err)
+	}
+	waitForValues(t, client, servers, "foo", "<bar>!")
+	servers[0].remove("foo")
+	if err := client.Prepend(&Item{Key: "foo", Value: []byte("!")}); err != nil {
+		t.Fatal(err)
+	}
+	waitForValues(t, client, servers, "foo", "!<bar>!")
+
+	// Keys missing on all nodes are not stored
+	if err := client.Append(&Item{Key: "missing", Value: []byte("x")}); err != memcache.ErrNotStored {
+		t.Errorf("expected ErrNotStored appending to a missing key, got %v", err)
+	}
+	if err := client.Prepend(&Item{Key: "missing", Value: []byte("x")}); err != memcache.ErrNotStored {
+		t.Errorf("expected ErrNotStored prepending to a missing key, got %v", err)
+	}
+	for _, server := range servers {
+		if _, found := server.value("missing"); found {
+			t.Errorf("expected missing key not to be written to %s", server.endpoint())
+		}
+	}
+}
+
+func TestReplaceRepair(t *testing.T) {
+	client, servers := newTestCluster(t, 3)
+	if err := client.Set(&Item{Key: "foo", Value: []byte("old")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The node missing the key is not stored by Replace, and is synchronised with the new value
+	servers[2].remove("foo")
+	if err := client.Replace(&Item{Key: "foo", Value: []byte("new")}); err != nil {
+		t.Fatalf("expected replace to succeed, got %v", err)
+	}
+	waitForValues(t, client, servers, "foo", "new")
+
+	// Synchronised nodes do not count towards the write consistency, but are still synchronised
+	servers[2].remove("foo")
+	ctx := WithWriteConsistency(context.Background(), CONSISTENCY_ALL)
+	if err := client.ReplaceContext(ctx, &Item{Key: "foo", Value: []byte("newer")}); !errors.Is(err, ErrInsufficientReplicas) {
+		t.Errorf("expected ErrInsufficientReplicas, got %v", err)
+	}
+	waitForValues(t, client, servers, "foo", "newer")
+
+	// A key missing on all nodes is not stored, and no node is synchronised
+	sets := servers[0].commands("set") + servers[1].commands("set") + servers[2].commands("set")
+	if err := client.Replace(&Item{Key: "missing", Value: []byte("new")}); err != memcache.ErrNotStored {
+		t.Errorf("expected ErrNotStored, got %v", err)
+	}
+	for _, server := range servers {
+		if _, found := server.value("missing"); found {
+			t.Errorf("expected missing key not to be written to %s", server.endpoint())
+		}
+	}
+	if repairs := servers[0].commands("set") + servers[1].commands("set") + servers[2].commands("set") - sets; repairs != 0 {
+		t.Errorf("expected no nodes to be synchronised, got %d sets", repairs)
+	}
+}
@@ -0,0 +1,132 @@
+package memcacheha
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"reflect"
+)
+
+// Codec marshals values to and from Item values. The name of the Codec is written in the header of each value, so
+// values are only unmarshaled by the Codec that marshaled them.
+type Codec interface {
+	// Name returns the name of this Codec, which must be unique and at most 255 bytes
+	Name() string
+
+	// Marshal returns the encoding of the given value
+	Marshal(v interface{}) ([]byte, error)
+
+	// Unmarshal decodes the given data into the value pointed to by v
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// funcCodec is a Codec using the given functions
+type funcCodec struct {
+	name      string
+	marshal   func(v interface{}) ([]byte, error)
+	unmarshal func(data []byte, v interface{}) error
+}
+
+// NewCodec returns a new Codec with the given name, using the given functions, e.g. NewCodec("msgpack", msgpack.Marshal, msgpack.Unmarshal)
+func NewCodec(name string, marshal func(v interface{}) ([]byte, error), unmarshal func(data []byte, v interface{}) error) Codec {
+	return &funcCodec{name: name, marshal: marshal, unmarshal: unmarshal}
+}
+
+func (codec *funcCodec) Name() string {
+	return codec.name
+}
+
+func (codec *funcCodec) Marshal(v interface{}) ([]byte, error) {
+	return codec.marshal(v)
+}
+
+func (codec *funcCodec) Unmarshal(data []byte, v interface{}) error {
+	return codec.unmarshal(data, v)
+}
+
+// JSONCodec is a Codec using encoding/json
+type JSONCodec struct{}
+
+func (codec JSONCodec) Name() string {
+	return "json"
+}
+
+func (codec JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (codec JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec is a Codec using encoding/gob
+type GobCodec struct{}
+
+func (codec GobCodec) Name() string {
+	return "gob"
+}
+
+func (codec GobCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (codec GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// ProtoMessage is implemented by protocol buffer messages that marshal themselves, such as those generated by gogoproto
+// or vtprotobuf
+type ProtoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+// ProtoCodec is a Codec for values implementing ProtoMessage. Values can be unmarshaled into a ProtoMessage, or a
+// pointer to a nil ProtoMessage pointer, which is allocated.
+type ProtoCodec struct{}
+
+func (codec ProtoCodec) Name() string {
+	return "protobuf"
+}
+
+func (codec ProtoCodec) Marshal(v interface{}) ([]byte, error) {
+	message, ok := v.(ProtoMessage)
+	if !ok {
+		return nil, ErrNotProtoMessage
+	}
+	return message.Marshal()
+}
+
+func (codec ProtoCodec) Unmarshal(data []byte, v interface{}) error {
+	if message, ok := v.(ProtoMessage); ok {
+		return message.Unmarshal(data)
+	}
+
+	// Allocate the message a pointer points to, e.g. for a TypedClient of a message pointer type
+	ptr := reflect.ValueOf(v)
+	if ptr.Kind() != reflect.Ptr || ptr.Elem().Kind() != reflect.Ptr {
+		return ErrNotProtoMessage
+	}
+	message, ok := reflect.New(ptr.Elem().Type().Elem()).Interface().(ProtoMessage)
+	if !ok {
+		return ErrNotProtoMessage
+	}
+	if err := message.Unmarshal(data); err != nil {
+		return err
+	}
+	ptr.Elem().Set(reflect.ValueOf(message))
+	return nil
+}
+
+var (
+	// ErrCodecMismatch is an error meaning a value was not written by the Codec reading it
+	ErrCodecMismatch = errors.New("memcacheha: codec mismatch")
+
+	// ErrNotProtoMessage is an error meaning a value passed to ProtoCodec does not implement ProtoMessage
+	ErrNotProtoMessage = errors.New("memcacheha: not a ProtoMessage")
+)
@@ -0,0 +1,90 @@
+package memcacheha
+
+import (
+	"bytes"
+	"testing"
+)
+
+type testLogger struct{}
+
+func (testLogger) Error(message string, args ...interface{}) {}
+func (testLogger) Warn(message string, args ...interface{})  {}
+func (testLogger) Info(message string, args ...interface{})  {}
+func (testLogger) Debug(message string, args ...interface{}) {}
+
+type testMessage struct {
+	data []byte
+}
+
+func (message *testMessage) Marshal() ([]byte, error) {
+	return message.data, nil
+}
+
+func (message *testMessage) Unmarshal(data []byte) error {
+	message.data = append([]byte{}, data...)
+	return nil
+}
+
+type testValue struct {
+	Name  string
+	Count int
+}
+
+func TestTypedClientRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec{}, GobCodec{}} {
+		typed := NewTypedClient[testValue](New(WithLogger(testLogger{})), codec)
+		value := testValue{Name: "foo", Count: 3}
+
+		item, err := typed.marshal("foo", value, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := NewItemFromMemcacheItem(item.AsMemcacheItem())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.codec != codec.Name() {
+			t.Errorf("expected codec %q, got %q", codec.Name(), out.codec)
+		}
+		outValue, err := typed.unmarshal(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outValue != value {
+			t.Errorf("%s: expected %+v, got %+v", codec.Name(), value, outValue)
+		}
+	}
+}
+
+func TestTypedClientCodecMismatch(t *testing.T) {
+	client := New(WithLogger(testLogger{}))
+	item, err := NewTypedClient[testValue](client, GobCodec{}).marshal("foo", testValue{Name: "foo"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTypedClient[testValue](client, JSONCodec{}).unmarshal(item); err != ErrCodecMismatch {
+		t.Errorf("expected ErrCodecMismatch, got %v", err)
+	}
+	if _, err := NewTypedClient[testValue](client, JSONCodec{}).unmarshal(&Item{Key: "foo", Value: []byte("{}")}); err != ErrCodecMismatch {
+		t.Errorf("expected ErrCodecMismatch for a value without a codec, got %v", err)
+	}
+}
+
+func TestProtoCodec(t *testing.T) {
+	typed := NewTypedClient[*testMessage](New(WithLogger(testLogger{})), ProtoCodec{})
+	item, err := typed.marshal("foo", &testMessage{data: []byte("bar")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := typed.unmarshal(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out == nil || !bytes.Equal(out.data, []byte("bar")) {
+		t.Errorf("expected bar, got %+v", out)
+	}
+
+	if _, err := (ProtoCodec{}).Marshal("bar"); err != ErrNotProtoMessage {
+		t.Errorf("expected ErrNotProtoMessage, got %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package memcacheha
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+// Compressor compresses and decompresses item values. A Compressor must be registered with RegisterCompressor, or be
+// the Compressor of the Encoding reading the value, for compressed values to be read.
+type Compressor interface {
+	// Name identifies the compressor in the header of compressed values (255 bytes maximum)
+	Name() string
+	Compress(value []byte) ([]byte, error)
+	Decompress(value []byte) ([]byte, error)
+}
+
+var (
+	compressorsMutex sync.RWMutex
+	compressors      = map[string]Compressor{}
+)
+
+func init() {
+	RegisterCompressor(&GzipCompressor{Level: gzip.DefaultCompression})
+}
+
+// RegisterCompressor registers the given Compressor to read values compressed with it, replacing any Compressor with the same Name
+func RegisterCompressor(compressor Compressor) {
+	compressorsMutex.Lock()
+	defer compressorsMutex.Unlock()
+	compressors[compressor.Name()] = compressor
+}
+
+// getCompressor returns the Compressor with the given name, preferring the Compressor of the given Encoding
+func getCompressor(name string, encoding *Encoding) Compressor {
+	if encoding != nil && encoding.Compressor != nil && encoding.Compressor.Name() == name {
+		return encoding.Compressor
+	}
+	compressorsMutex.RLock()
+	defer compressorsMutex.RUnlock()
+	return compressors[name]
+}
+
+// GzipCompressor is a Compressor using gzip at the given Level
+type GzipCompressor struct {
+	Level int
+}
+
+// Name implements Compressor
+func (gzipCompressor *GzipCompressor) Name() string {
+	return "gzip"
+}
+
+// Compress implements Compressor
+func (gzipCompressor *GzipCompressor) Compress(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buf, gzipCompressor.Level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = writer.Write(value); err != nil {
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress implements Compressor
+func (gzipCompressor *GzipCompressor) Decompress(value []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
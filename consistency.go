@@ -0,0 +1,68 @@
+package memcacheha
+
+import (
+	"context"
+)
+
+// Consistency is the number of nodes that must respond to an operation for it to succeed. Positive values are an
+// explicit number of nodes, CONSISTENCY_ONE, CONSISTENCY_QUORUM and CONSISTENCY_ALL are relative to the number of nodes
+// in the cluster.
+type Consistency int
+
+const (
+	// CONSISTENCY_DEFAULT reads from Ceil(n/2) nodes, and writes succeed while at least one node is healthy
+	CONSISTENCY_DEFAULT Consistency = 0
+	// CONSISTENCY_ONE requires a response from one node
+	CONSISTENCY_ONE Consistency = -1
+	// CONSISTENCY_QUORUM requires responses from a majority of nodes, i.e. floor(n/2)+1
+	CONSISTENCY_QUORUM Consistency = -2
+	// CONSISTENCY_ALL requires responses from all nodes
+	CONSISTENCY_ALL Consistency = -3
+)
+
+// Nodes returns the number of nodes required out of n nodes in the cluster, or 0 for CONSISTENCY_DEFAULT
+func (consistency Consistency) Nodes(n int) int {
+	switch consistency {
+	case CONSISTENCY_ONE:
+		return 1
+	case CONSISTENCY_QUORUM:
+		return n/2 + 1
+	case CONSISTENCY_ALL:
+		return n
+	}
+	if consistency > 0 {
+		return int(consistency)
+	}
+	return 0
+}
+
+type readConsistencyKey struct{}
+type writeConsistencyKey struct{}
+
+// WithReadConsistency returns a copy of ctx that overrides the Client ReadConsistency for reads made with it
+func WithReadConsistency(ctx context.Context, consistency Consistency) context.Context {
+	return context.WithValue(ctx, readConsistencyKey{}, consistency)
+}
+
+// WithWriteConsistency returns a copy of ctx that overrides the Client WriteConsistency for writes made with it
+func WithWriteConsistency(ctx context.Context, consistency Consistency) context.Context {
+	return context.WithValue(ctx, writeConsistencyKey{}, consistency)
+}
+
+// readNodesRequired returns the number of agreeing nodes required for a read made with ctx
+func (client *Client) readNodesRequired(ctx context.Context) int {
+	consistency, ok := ctx.Value(readConsistencyKey{}).(Consistency)
+	if !ok {
+		consistency = client.ReadConsistency
+	}
+	return consistency.Nodes(client.Nodes.GetNodeCount())
+}
+
+// writeNodesRequired returns the number of acknowledging nodes required for a write made with ctx
+func (client *Client) writeNodesRequired(ctx context.Context) int {
+	consistency, ok := ctx.Value(writeConsistencyKey{}).(Consistency)
+	if !ok {
+		consistency = client.WriteConsistency
+	}
+	return consistency.Nodes(client.Nodes.GetNodeCount())
+}
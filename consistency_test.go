@@ -0,0 +1,62 @@
+package memcacheha
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestConsistencyNodes(t *testing.T) {
+	tests := []struct {
+		consistency Consistency
+		n           int
+		expected    int
+	}{
+		{CONSISTENCY_DEFAULT, 3, 0},
+		{CONSISTENCY_ONE, 3, 1},
+		{CONSISTENCY_QUORUM, 1, 1},
+		{CONSISTENCY_QUORUM, 2, 2},
+		{CONSISTENCY_QUORUM, 3, 2},
+		{CONSISTENCY_QUORUM, 4, 3},
+		{CONSISTENCY_ALL, 3, 3},
+		{Consistency(2), 5, 2},
+	}
+	for _, test := range tests {
+		if actual := test.consistency.Nodes(test.n); actual != test.expected {
+			t.Errorf("Consistency(%d).Nodes(%d): expected %d, got %d", test.consistency, test.n, test.expected, actual)
+		}
+	}
+}
+
+func TestCompareAndSwapWriteConsistency(t *testing.T) {
+	client, servers := newTestCluster(t, 3, WithDefaultWriteConsistency(CONSISTENCY_ALL))
+	if err := client.Set(&Item{Key: "counter", Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two nodes swap, and the node missing the key is synchronised, which does not meet CONSISTENCY_ALL
+	servers[2].remove("counter")
+	if _, err := client.Increment("counter", 1); !errors.Is(err, ErrInsufficientReplicas) {
+		t.Errorf("expected ErrInsufficientReplicas, got %v", err)
+	}
+
+	// A quorum is met
+	servers[2].remove("counter")
+	ctx := WithWriteConsistency(context.Background(), CONSISTENCY_QUORUM)
+	if _, err := client.IncrementContext(ctx, "counter", 1); err != nil {
+		t.Errorf("expected quorum write to succeed, got %v", err)
+	}
+
+	// Too few healthy nodes fail before reading
+	client.Nodes.GetNodes()[servers[0].endpoint()].markUnhealthy(errors.New("timeout"))
+	if _, err := client.Increment("counter", 1); err != ErrInsufficientReplicas {
+		t.Errorf("expected ErrInsufficientReplicas, got %v", err)
+	}
+	item, err := client.GetForUpdate("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CompareAndSwap(item); err != ErrInsufficientReplicas {
+		t.Errorf("expected ErrInsufficientReplicas, got %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package memcacheha
+
+import (
+	"hash/crc32"
+	"strings"
+)
+
+// castagnoliTable is the CRC32C table used for value checksums
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Encoding configures how Items are encoded as memcache values by a Client
+type Encoding struct {
+	// Checksum adds a CRC32C checksum of the value to the header of written items. Checksums are always verified when read.
+	Checksum bool
+
+	// Compressor compresses values of at least CompressThreshold bytes, if not nil. Values are stored uncompressed if
+	// compression does not make them smaller.
+	Compressor        Compressor
+	CompressThreshold int
+
+	// Keys encrypts values with its current key, if not nil. Encrypted values are only read with a KeyRing holding their key.
+	Keys *KeyRing
+
+	// Raw reads and writes values without the memcacheha header, so they can be shared with other memcache clients.
+	// RawKeyPrefixes does the same only for keys with any of the given prefixes. Raw values have no expiry or timestamp,
+	// so nodes holding different values are not resolved by age, and cannot be deleted with tombstones or chunked.
+	Raw            bool
+	RawKeyPrefixes []string
+
+	// AcceptRaw reads values without the memcacheha header, instead of ignoring them with ErrNotMemcacheHAKey. They are
+	// rewritten with the header when nodes are synchronised.
+	AcceptRaw bool
+
+	// LegacyHeader writes values with the original header, holding only the expiry, so they can be read by versions of
+	// memcacheha that do not read the versioned header, until all clients are upgraded. Values are written without a
+	// timestamp, so nodes holding different values are not resolved by age. Tombstones, chunked values, and values
+	// written by a TypedClient or with Checksum, Compressor or Keys set are still written with the versioned header.
+	LegacyHeader bool
+}
+
+// isRaw returns true if the value for the given key is read and written without the memcacheha header
+func (encoding *Encoding) isRaw(key string) bool {
+	if encoding == nil {
+		return false
+	}
+	if encoding.Raw {
+		return true
+	}
+	for _, prefix := range encoding.RawKeyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package memcacheha
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+// KeyRing holds AES-GCM keys to encrypt and decrypt values, identified by key ID. Values are encrypted with the current
+// key, and can be decrypted with any key in the KeyRing, so keys can be rotated by adding the new key to all clients
+// before making it current.
+type KeyRing struct {
+	currentID string
+	aeads     map[string]cipher.AEAD
+}
+
+// NewKeyRing returns a new KeyRing with the given keys by key ID, encrypting with the key with the given current ID.
+// Keys must be 16, 24 or 32 bytes to select AES-128, AES-192 or AES-256, and key IDs must be 1 to 255 bytes.
+func NewKeyRing(currentID string, keys map[string][]byte) (*KeyRing, error) {
+	keyRing := &KeyRing{
+		currentID: currentID,
+		aeads:     map[string]cipher.AEAD{},
+	}
+	for id, key := range keys {
+		if len(id) == 0 || len(id) > 255 {
+			return nil, ErrInvalidKeyID
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keyRing.aeads[id] = aead
+	}
+	if _, found := keyRing.aeads[currentID]; !found {
+		return nil, ErrUnknownKeyID
+	}
+	return keyRing, nil
+}
+
+// encrypt encrypts the given value with the key with the current ID, authenticating the given additional data. It
+// returns the ciphertext, prefixed with a random nonce.
+func (keyRing *KeyRing) encrypt(value []byte, additionalData []byte) ([]byte, error) {
+	aead := keyRing.aeads[keyRing.currentID]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, value, additionalData), nil
+}
+
+// decrypt decrypts the given nonce-prefixed ciphertext with the key with the given ID, authenticating the given
+// additional data.
+func (keyRing *KeyRing) decrypt(id string, value []byte, additionalData []byte) ([]byte, error) {
+	aead, found := keyRing.aeads[id]
+	if !found {
+		return nil, ErrUnknownKeyID
+	}
+	if len(value) < aead.NonceSize() {
+		return nil, ErrDecryptionFailed
+	}
+	out, err := aead.Open(nil, value[:aead.NonceSize()], value[aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return out, nil
+}
+
+var (
+	// ErrInvalidKeyID is an error meaning a KeyRing key ID is empty or longer than 255 bytes
+	ErrInvalidKeyID = errors.New("memcacheha: invalid encryption key ID")
+
+	// ErrUnknownKeyID is an error meaning a value is encrypted with a key that is not in the KeyRing, or there is no KeyRing
+	ErrUnknownKeyID = errors.New("memcacheha: unknown encryption key ID")
+
+	// ErrDecryptionFailed is an error meaning an encrypted value could not be decrypted or authenticated
+	ErrDecryptionFailed = errors.New("memcacheha: decryption failed")
+)
@@ -14,6 +14,15 @@ var (
 	// ErrNoHealthyNodes is an error meaning there are no nodes that can be contacted
 	ErrNoHealthyNodes = errors.New("memcacheha: no healthy nodes")
 
+	// ErrNoCASID is an error meaning CompareAndSwap has been called with an item that was not returned by GetForUpdate
+	ErrNoCASID = errors.New("memcacheha: item has no CAS id")
+
+	// ErrNonNumericValue is an error meaning Increment or Decrement has been called on a key whose value is not a decimal number
+	ErrNonNumericValue = errors.New("memcacheha: cannot increment or decrement non-numeric value")
+
+	// ErrInsufficientReplicas is an error meaning fewer nodes responded or agreed than required by the consistency level
+	ErrInsufficientReplicas = errors.New("memcacheha: insufficient replicas")
+
 	// ErrUnknown represents an internal panic()
 	ErrUnknown = errors.New("memcacheha: unknown error occurred")
 )
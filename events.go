@@ -0,0 +1,113 @@
+package memcacheha
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType is the type of an Event
+type EventType int
+
+const (
+	// EVENT_NODE_ADDED is emitted when a node is discovered by a NodeSource
+	EVENT_NODE_ADDED EventType = iota + 1
+	// EVENT_NODE_REMOVED is emitted when a node is no longer returned by any NodeSource
+	EVENT_NODE_REMOVED
+	// EVENT_NODE_HEALTHY is emitted when a node becomes healthy
+	EVENT_NODE_HEALTHY
+	// EVENT_NODE_UNHEALTHY is emitted when a node becomes unhealthy, with the error that caused it
+	EVENT_NODE_UNHEALTHY
+	// EVENT_REPAIR_PERFORMED is emitted when nodes are synchronised with an item, with the operation and number of nodes
+	EVENT_REPAIR_PERFORMED
+	// EVENT_SOURCE_ERROR is emitted when a NodeSource returns an error
+	EVENT_SOURCE_ERROR
+)
+
+func (eventType EventType) String() string {
+	switch eventType {
+	case EVENT_NODE_ADDED:
+		return "NodeAdded"
+	case EVENT_NODE_REMOVED:
+		return "NodeRemoved"
+	case EVENT_NODE_HEALTHY:
+		return "NodeHealthy"
+	case EVENT_NODE_UNHEALTHY:
+		return "NodeUnhealthy"
+	case EVENT_REPAIR_PERFORMED:
+		return "RepairPerformed"
+	case EVENT_SOURCE_ERROR:
+		return "SourceError"
+	}
+	return "Unknown"
+}
+
+// Event is a change in the nodes of a Client, passed to the handlers subscribed with Client.Subscribe
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Endpoint is the endpoint of the node, for node events
+	Endpoint string
+
+	// Op, Key and Nodes are the operation, the key, and the number of nodes synchronised by a repair
+	Op    string
+	Key   string
+	Nodes int
+
+	// Err is the cause of an unhealthy node or source error
+	Err error
+}
+
+// eventBus calls the subscribed handlers with each event emitted
+type eventBus struct {
+	lock     sync.RWMutex
+	handlers map[int]func(event Event)
+	nextID   int
+}
+
+// newEventBus returns a new eventBus without handlers
+func newEventBus() *eventBus {
+	return &eventBus{
+		handlers: map[int]func(event Event){},
+	}
+}
+
+// subscribe adds the given handler, returning a function that removes it
+func (bus *eventBus) subscribe(handler func(event Event)) func() {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	id := bus.nextID
+	bus.nextID++
+	bus.handlers[id] = handler
+	return func() {
+		bus.lock.Lock()
+		defer bus.lock.Unlock()
+		delete(bus.handlers, id)
+	}
+}
+
+// emit timestamps the given event and calls all handlers with it. The bus may be nil, e.g. for a Node created outside a Client.
+func (bus *eventBus) emit(event Event) {
+	if bus == nil {
+		return
+	}
+	event.Time = time.Now()
+
+	bus.lock.RLock()
+	handlers := make([]func(event Event), 0, len(bus.handlers))
+	for _, handler := range bus.handlers {
+		handlers = append(handlers, handler)
+	}
+	bus.lock.RUnlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+// Subscribe calls the given handler with every Event, until the returned function is called. Handlers are called from the
+// goroutine of the operation that caused the event, and must not block.
+func (client *Client) Subscribe(handler func(event Event)) func() {
+	return client.events.subscribe(handler)
+}
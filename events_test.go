@@ -0,0 +1,83 @@
+package memcacheha
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+type testNodeSource struct {
+	nodes []string
+	err   error
+}
+
+func (source *testNodeSource) GetNodes() ([]string, error) {
+	return source.nodes, source.err
+}
+
+func TestClientEvents(t *testing.T) {
+	source := &testNodeSource{nodes: []string{"127.0.0.1:1"}}
+	client := New(WithLogger(testLogger{}), WithSources(source))
+
+	lock := sync.Mutex{}
+	var events []Event
+	unsubscribe := client.Subscribe(func(event Event) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, event)
+	})
+
+	client.GetNodes()
+	node := client.Nodes.GetNodes()["127.0.0.1:1"]
+	node.markHealthy()
+	node.markUnhealthy(errors.New("timeout"))
+	source.err = errors.New("unavailable")
+	client.GetNodes()
+	source.nodes, source.err = nil, nil
+	client.GetNodes()
+
+	unsubscribe()
+	node.markHealthy()
+
+	expected := []EventType{EVENT_NODE_ADDED, EVENT_NODE_HEALTHY, EVENT_NODE_UNHEALTHY, EVENT_SOURCE_ERROR, EVENT_NODE_REMOVED}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, events)
+	}
+	for i, event := range events {
+		if event.Type != expected[i] || event.Time.IsZero() {
+			t.Errorf("expected %s event, got %+v", expected[i], event)
+		}
+	}
+	if events[2].Endpoint != "127.0.0.1:1" || events[2].Err == nil {
+		t.Errorf("expected unhealthy node with cause, got %+v", events[2])
+	}
+}
+
+func TestClientAddRepairEvent(t *testing.T) {
+	client, servers := newTestCluster(t, 2)
+	existing := (&Item{Key: "foo", Value: []byte("old")}).AsMemcacheItem()
+	if err := client.Nodes.GetNodes()[servers[0].endpoint()].client.Set(existing); err != nil {
+		t.Fatal(err)
+	}
+
+	lock := sync.Mutex{}
+	var repairs []Event
+	client.Subscribe(func(event Event) {
+		lock.Lock()
+		defer lock.Unlock()
+		if event.Type == EVENT_REPAIR_PERFORMED && event.Op == "Add" {
+			repairs = append(repairs, event)
+		}
+	})
+
+	if err := client.Add(&Item{Key: "foo", Value: []byte("new")}); err != memcache.ErrNotStored {
+		t.Fatalf("expected ErrNotStored, got %v", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(repairs) != 1 || repairs[0].Key != "foo" || repairs[0].Nodes != 1 {
+		t.Errorf("expected Add repair of 1 node, got %+v", repairs)
+	}
+}
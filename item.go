@@ -1,14 +1,88 @@
 package memcacheha
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"github.com/bradfitz/gomemcache/memcache"
+	"hash/crc32"
+	"math"
 	"time"
 )
 
 var MEMCACHEHA_HEADER []byte = []byte{0xfd, 0x37, 0xd3, 0x1b}
+
+// MEMCACHEHA_VERSIONED_HEADER identifies values with a versioned header, see AsMemcacheItem
+var MEMCACHEHA_VERSIONED_HEADER []byte = []byte{0xfd, 0x37, 0xd3, 0x1d}
+
+const (
+	// HEADER_VERSION is the version of the versioned header written and read by this client
+	HEADER_VERSION byte = 2
+)
+
+const (
+	// HEADER_FLAG_TOMBSTONE marks an item as a tombstone for a deleted key
+	HEADER_FLAG_TOMBSTONE byte = 0x01
+
+	// HEADER_FLAG_COMPRESSED marks the value of a versioned header as compressed with the Compressor named in the
+	// HEADER_FIELD_COMPRESSOR field
+	HEADER_FLAG_COMPRESSED byte = 0x04
+
+	// HEADER_FLAG_ENCRYPTED marks the value of a versioned header as encrypted with the key identified in the
+	// HEADER_FIELD_KEY_ID field
+	HEADER_FLAG_ENCRYPTED byte = 0x08
+
+	// HEADER_FLAG_CHUNKED marks the value of a versioned header as a manifest of the chunks holding the value, see Client.ChunkSize
+	HEADER_FLAG_CHUNKED byte = 0x10
+
+	// HEADER_FLAG_MUST_UNDERSTAND marks that the other flags change how the value is read, so a client that does not
+	// support all of them must not read it. Without it, unsupported flags are ignored.
+	HEADER_FLAG_MUST_UNDERSTAND byte = 0x80
+
+	// HEADER_FLAGS_SUPPORTED are the flags understood in a versioned header
+	HEADER_FLAGS_SUPPORTED = HEADER_FLAG_TOMBSTONE | HEADER_FLAG_COMPRESSED | HEADER_FLAG_ENCRYPTED | HEADER_FLAG_CHUNKED | HEADER_FLAG_MUST_UNDERSTAND
+)
+
+const (
+	// HEADER_FIELD_EXPIRY is a versioned header field holding a big-endian 32 bit UNIX expiry time. It is read but no
+	// longer written, see HEADER_FIELD_EXPIRY_MS.
+	HEADER_FIELD_EXPIRY byte = 0x01
+	// HEADER_FIELD_TIMESTAMP is a versioned header field holding a big-endian 64 bit UNIX nanosecond write timestamp
+	HEADER_FIELD_TIMESTAMP byte = 0x02
+	// HEADER_FIELD_EXPIRY_MS is a versioned header field holding a big-endian 64 bit UNIX millisecond expiry time
+	HEADER_FIELD_EXPIRY_MS byte = 0x03
+	// HEADER_FIELD_CHECKSUM is a versioned header field holding a big-endian 32 bit CRC32C checksum of the stored value
+	HEADER_FIELD_CHECKSUM byte = 0x04
+	// HEADER_FIELD_COMPRESSOR is a versioned header field holding the name of the Compressor of a compressed value
+	HEADER_FIELD_COMPRESSOR byte = 0x05
+	// HEADER_FIELD_KEY_ID is a versioned header field holding the KeyRing key ID of an encrypted value
+	HEADER_FIELD_KEY_ID byte = 0x06
+	// HEADER_FIELD_CODEC is a versioned header field holding the name of the Codec of a value written by a TypedClient
+	HEADER_FIELD_CODEC byte = 0x07
+	// HEADER_FIELD_OPERATIONS is a versioned header field holding the big-endian 64 bit ids of the most recent
+	// read-modify-write operations applied to the value, see OPERATION_HISTORY_LENGTH
+	HEADER_FIELD_OPERATIONS byte = 0x08
+)
+
+// OPERATION_HISTORY_LENGTH is the number of read-modify-write operations recorded in the header of a value, so an
+// operation retried after a partial write is not applied twice
+const OPERATION_HISTORY_LENGTH = 16
+
+// MEMCACHE_MAX_RELATIVE_EXPIRY is the longest expiry memcached accepts as relative, longer expiries are absolute UNIX times
+const MEMCACHE_MAX_RELATIVE_EXPIRY = 30 * 24 * 60 * 60
+
 var ErrNotMemcacheHAKey = errors.New("not a memcacheha key")
 
+// ErrChecksumMismatch is an error meaning a value does not match the checksum in its header
+var ErrChecksumMismatch = errors.New("memcacheha: checksum mismatch")
+
+// ErrUnknownCompressor is an error meaning a value is compressed with a Compressor that has not been registered
+var ErrUnknownCompressor = errors.New("memcacheha: unknown compressor")
+
+// ErrUnsupportedHeader is an error meaning a value has a memcacheha header with a version this client cannot read, or
+// flags it must understand but does not
+var ErrUnsupportedHeader = errors.New("memcacheha: unsupported header")
+
 type Item struct {
 	// Key is the Item's key (250 bytes maximum).
 	Key string
@@ -22,22 +96,93 @@ type Item struct {
 
 	// Expiration is either nil (no expiry) or an absolute expiry time
 	Expiration *time.Time
+
+	// Timestamp is the time the item was written, set by the Client on write. It is used to resolve
+	// different items on different nodes, the newest wins.
+	Timestamp time.Time
+
+	// casItems are the items read from each node endpoint, holding their CAS ids
+	casItems map[string]*memcache.Item
+
+	// tombstone is true if this item marks a deleted key
+	tombstone bool
+
+	// chunked is true if the value of this item is a manifest of the chunks holding the value
+	chunked bool
+
+	// raw is true if this item was read without a header, and should be rewritten with one
+	raw bool
+
+	// codec is the name of the Codec of the value, if written by a TypedClient
+	codec string
+
+	// operations are the ids of the most recent read-modify-write operations applied to the value, oldest first
+	operations []uint64
+}
+
+// newTombstone returns a tombstone item for the given key, expiring at the given time
+func newTombstone(key string, expiration time.Time) *Item {
+	return &Item{
+		Key:        key,
+		Value:      []byte{},
+		Expiration: &expiration,
+		Timestamp:  time.Now(),
+		tombstone:  true,
+	}
 }
 
+// NewItemFromMemcacheItem returns a new Item from the given memcache item, reading the expiry and other metadata from its
+// header. Values written with the original or versioned headers can be read.
 func NewItemFromMemcacheItem(item *memcache.Item) (*Item, error) {
+	return decodeItem(item, nil)
+}
+
+// decodeItem returns a new Item from the given memcache item, as NewItemFromMemcacheItem, with the given Encoding if not nil
+func decodeItem(item *memcache.Item, encoding *Encoding) (*Item, error) {
+	// Read raw keys as they are
+	if encoding.isRaw(item.Key) {
+		return newRawItem(item), nil
+	}
 
+	haItem, err := decodeHeader(item, encoding)
+	if err == ErrNotMemcacheHAKey && encoding != nil && encoding.AcceptRaw {
+		// Read values written by other clients, to be rewritten with a header
+		haItem, err = newRawItem(item), nil
+		haItem.raw = true
+	}
+	return haItem, err
+}
+
+// decodeHeader returns a new Item from the given memcache item with any of the memcacheha headers
+func decodeHeader(item *memcache.Item, encoding *Encoding) (*Item, error) {
 	// Check basic header length
 	if len(item.Value) < 8 {
 		return nil, ErrNotMemcacheHAKey
 	}
 
 	// Check header
-	for i, x := range MEMCACHEHA_HEADER {
-		if item.Value[i] != x {
-			return nil, ErrNotMemcacheHAKey
-		}
+	switch {
+	case bytes.Equal(item.Value[:4], MEMCACHEHA_VERSIONED_HEADER):
+		return newItemFromVersionedHeader(item, encoding)
+	case bytes.Equal(item.Value[:4], MEMCACHEHA_HEADER):
+		return newItemFromHeader(item), nil
 	}
+	return nil, ErrNotMemcacheHAKey
+}
 
+// newRawItem returns a new Item from the given memcache item without a header, which has no expiry or timestamp
+func newRawItem(item *memcache.Item) *Item {
+	return &Item{
+		Key:   item.Key,
+		Value: item.Value,
+		Flags: item.Flags,
+	}
+}
+
+// newItemFromHeader reads an item with the original header:
+//
+//	magic (4 bytes) | expiry (4 bytes) | value
+func newItemFromHeader(item *memcache.Item) *Item {
 	// Read Expiration
 	var mcExpiry uint32
 	mcExpiry = mcExpiry | uint32(item.Value[4])<<24
@@ -56,39 +201,277 @@ func NewItemFromMemcacheItem(item *memcache.Item) (*Item, error) {
 		Value:      item.Value[8:],
 		Flags:      item.Flags,
 		Expiration: haExpiry,
-	}, nil
+	}
 }
 
+// newItemFromVersionedHeader reads an item with the versioned header:
+//
+//	magic (4 bytes) | version (1 byte) | flags (1 byte) | fields length (2 bytes) | fields | value
+//
+// where each field is:
+//
+//	type (1 byte) | length (1 byte) | data
+//
+// Fields of unknown type and unsupported flags are skipped, so they can be added without breaking older clients. Values
+// with a different version, or unsupported flags with HEADER_FLAG_MUST_UNDERSTAND, return ErrUnsupportedHeader.
+func newItemFromVersionedHeader(item *memcache.Item, encoding *Encoding) (*Item, error) {
+	if item.Value[4] != HEADER_VERSION {
+		return nil, ErrUnsupportedHeader
+	}
+	flags := item.Value[5]
+	if flags&HEADER_FLAG_MUST_UNDERSTAND != 0 && flags&^HEADER_FLAGS_SUPPORTED != 0 {
+		return nil, ErrUnsupportedHeader
+	}
+	headerLength := 8 + int(binary.BigEndian.Uint16(item.Value[6:8]))
+	if len(item.Value) < headerLength {
+		return nil, ErrNotMemcacheHAKey
+	}
+
+	haItem := &Item{
+		Key:       item.Key,
+		Value:     item.Value[headerLength:],
+		Flags:     item.Flags,
+		tombstone: flags&HEADER_FLAG_TOMBSTONE != 0,
+		chunked:   flags&HEADER_FLAG_CHUNKED != 0,
+	}
+
+	// Read fields
+	var checksum *uint32
+	var compressorName string
+	var keyID string
+	var authenticatedFields []byte
+	allFields := item.Value[8:headerLength]
+	fields := allFields
+	for len(fields) > 0 {
+		if len(fields) < 2 || len(fields) < 2+int(fields[1]) {
+			return nil, ErrNotMemcacheHAKey
+		}
+		fieldType, data := fields[0], fields[2:2+int(fields[1])]
+		fields = fields[2+len(data):]
+
+		switch fieldType {
+		case HEADER_FIELD_EXPIRY:
+			if len(data) != 4 {
+				return nil, ErrNotMemcacheHAKey
+			}
+			expiry := time.Unix(int64(binary.BigEndian.Uint32(data)), 0)
+			haItem.Expiration = &expiry
+		case HEADER_FIELD_EXPIRY_MS:
+			if len(data) != 8 {
+				return nil, ErrNotMemcacheHAKey
+			}
+			expiry := time.UnixMilli(int64(binary.BigEndian.Uint64(data)))
+			haItem.Expiration = &expiry
+		case HEADER_FIELD_TIMESTAMP:
+			if len(data) != 8 {
+				return nil, ErrNotMemcacheHAKey
+			}
+			haItem.Timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+		case HEADER_FIELD_CHECKSUM:
+			if len(data) != 4 {
+				return nil, ErrNotMemcacheHAKey
+			}
+			x := binary.BigEndian.Uint32(data)
+			checksum = &x
+		case HEADER_FIELD_COMPRESSOR:
+			compressorName = string(data)
+		case HEADER_FIELD_KEY_ID:
+			keyID = string(data)
+			authenticatedFields = allFields[:len(allFields)-len(fields)]
+		case HEADER_FIELD_CODEC:
+			haItem.codec = string(data)
+		case HEADER_FIELD_OPERATIONS:
+			if len(data)%8 != 0 {
+				return nil, ErrNotMemcacheHAKey
+			}
+			haItem.operations = make([]uint64, 0, len(data)/8)
+			for ; len(data) > 0; data = data[8:] {
+				haItem.operations = append(haItem.operations, binary.BigEndian.Uint64(data))
+			}
+		}
+	}
+
+	// Verify checksum
+	if checksum != nil && crc32.Checksum(haItem.Value, castagnoliTable) != *checksum {
+		return nil, ErrChecksumMismatch
+	}
+
+	// Decrypt, authenticating the key and header
+	if flags&HEADER_FLAG_ENCRYPTED != 0 {
+		if encoding == nil || encoding.Keys == nil {
+			return nil, ErrUnknownKeyID
+		}
+		additionalData := encryptionAdditionalData(item.Key, flags, authenticatedFields)
+		value, err := encoding.Keys.decrypt(keyID, haItem.Value, additionalData)
+		if err != nil {
+			return nil, err
+		}
+		haItem.Value = value
+	}
+
+	// Decompress
+	if flags&HEADER_FLAG_COMPRESSED != 0 {
+		compressor := getCompressor(compressorName, encoding)
+		if compressor == nil {
+			return nil, ErrUnknownCompressor
+		}
+		value, err := compressor.Decompress(haItem.Value)
+		if err != nil {
+			return nil, err
+		}
+		haItem.Value = value
+	}
+
+	return haItem, nil
+}
+
+// AsMemcacheItem returns a memcache item for this item, with a versioned header holding its expiry and other metadata
 func (item *Item) AsMemcacheItem() *memcache.Item {
+	// Without an Encoding, encode cannot fail
+	mcItem, _ := item.encode(nil)
+	return mcItem
+}
+
+// encode returns a memcache item for this item, as AsMemcacheItem, with the given Encoding if not nil
+func (item *Item) encode(encoding *Encoding) (*memcache.Item, error) {
 	var mcExpiry int32
-	var binTime []byte = make([]byte, 4)
+
+	// Write raw keys as they are
+	if encoding.isRaw(item.Key) {
+		if item.Expiration != nil {
+			mcExpiry = memcacheExpiration(*item.Expiration)
+		}
+		return &memcache.Item{
+			Key:        item.Key,
+			Value:      item.Value,
+			Flags:      item.Flags,
+			Expiration: mcExpiry,
+		}, nil
+	}
+
+	if encoding != nil && encoding.LegacyHeader && item.legacyEncodable(encoding) {
+		return item.encodeLegacy(), nil
+	}
+
+	// Flags that change how the value is read are written with HEADER_FLAG_MUST_UNDERSTAND
+	var fields []byte
+	var flags byte
+	if item.tombstone {
+		flags |= HEADER_FLAG_TOMBSTONE
+	}
+	if item.chunked {
+		flags |= HEADER_FLAG_CHUNKED | HEADER_FLAG_MUST_UNDERSTAND
+	}
+
+	// Compress the value, if smaller
+	data := item.Value
+	if encoding != nil && encoding.Compressor != nil && len(data) >= encoding.CompressThreshold {
+		compressed, err := encoding.Compressor.Compress(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(data) {
+			data = compressed
+			flags |= HEADER_FLAG_COMPRESSED | HEADER_FLAG_MUST_UNDERSTAND
+			fields = appendHeaderField(fields, HEADER_FIELD_COMPRESSOR, []byte(encoding.Compressor.Name()))
+		}
+	}
 
 	if item.Expiration != nil {
-		// Write Expiration Int32
-		mcExpiry = int32(item.Expiration.Unix())
-		binTime[0] = byte((mcExpiry >> 24) & 0xFF)
-		binTime[1] = byte((mcExpiry >> 16) & 0xFF)
-		binTime[2] = byte((mcExpiry >> 8) & 0xFF)
-		binTime[3] = byte(mcExpiry & 0xFF)
-
-		// Change to relative for memcached
-		mcExpiry = mcExpiry - int32(time.Now().Unix())
-
-		// Catch negative offset (expire now)
-		if mcExpiry < 1 {
-			mcExpiry = 1
+		// Write Expiration Int64 milliseconds
+		binTime := make([]byte, 8)
+		binary.BigEndian.PutUint64(binTime, uint64(item.Expiration.UnixMilli()))
+		fields = appendHeaderField(fields, HEADER_FIELD_EXPIRY_MS, binTime)
+
+		mcExpiry = memcacheExpiration(*item.Expiration)
+	}
+
+	// Write timestamp
+	if !item.Timestamp.IsZero() {
+		binTimestamp := make([]byte, 8)
+		binary.BigEndian.PutUint64(binTimestamp, uint64(item.Timestamp.UnixNano()))
+		fields = appendHeaderField(fields, HEADER_FIELD_TIMESTAMP, binTimestamp)
+	}
+
+	// Write codec
+	if item.codec != "" {
+		fields = appendHeaderField(fields, HEADER_FIELD_CODEC, []byte(item.codec))
+	}
+
+	// Write operation history
+	if len(item.operations) > 0 {
+		binOperations := make([]byte, 8*len(item.operations))
+		for i, operation := range item.operations {
+			binary.BigEndian.PutUint64(binOperations[8*i:], operation)
 		}
+		fields = appendHeaderField(fields, HEADER_FIELD_OPERATIONS, binOperations)
 	}
 
-	var value []byte
+	// Encrypt the value, authenticating the key and header
+	if encoding != nil && encoding.Keys != nil {
+		flags |= HEADER_FLAG_ENCRYPTED | HEADER_FLAG_MUST_UNDERSTAND
+		fields = appendHeaderField(fields, HEADER_FIELD_KEY_ID, []byte(encoding.Keys.currentID))
+		encrypted, err := encoding.Keys.encrypt(data, encryptionAdditionalData(item.Key, flags, fields))
+		if err != nil {
+			return nil, err
+		}
+		data = encrypted
+	}
 
-	// Write Header
-	value = append(value, MEMCACHEHA_HEADER...)
+	// Write checksum
+	if encoding != nil && encoding.Checksum {
+		binChecksum := make([]byte, 4)
+		binary.BigEndian.PutUint32(binChecksum, crc32.Checksum(data, castagnoliTable))
+		fields = appendHeaderField(fields, HEADER_FIELD_CHECKSUM, binChecksum)
+	}
+
+	value := make([]byte, 0, 8+len(fields)+len(data))
 
-	// Write expiry time
-	value = append(value, binTime...)
+	// Write Header
+	value = append(value, MEMCACHEHA_VERSIONED_HEADER...)
+	value = append(value, HEADER_VERSION, flags, byte(len(fields)>>8), byte(len(fields)))
+	value = append(value, fields...)
 
 	// Write Data
+	value = append(value, data...)
+
+	return &memcache.Item{
+		Key:        item.Key,
+		Value:      value,
+		Flags:      item.Flags,
+		Expiration: mcExpiry,
+	}, nil
+}
+
+// legacyEncodable returns true if this item can be written with the original header, which has no flags or fields
+// other than the expiry, with the given Encoding
+func (item *Item) legacyEncodable(encoding *Encoding) bool {
+	if item.tombstone || item.chunked || item.codec != "" || len(item.operations) > 0 {
+		return false
+	}
+	if encoding.Compressor != nil || encoding.Keys != nil || encoding.Checksum {
+		return false
+	}
+	return item.Expiration == nil || (item.Expiration.Unix() > 0 && item.Expiration.Unix() <= math.MaxUint32)
+}
+
+// encodeLegacy returns a memcache item for this item with the original header:
+//
+//	magic (4 bytes) | expiry (4 bytes) | value
+func (item *Item) encodeLegacy() *memcache.Item {
+	var mcExpiry int32
+	var expiry uint32
+	if item.Expiration != nil {
+		mcExpiry = memcacheExpiration(*item.Expiration)
+		expiry = uint32(item.Expiration.Unix())
+	}
+
+	binExpiry := make([]byte, 4)
+	binary.BigEndian.PutUint32(binExpiry, expiry)
+
+	value := make([]byte, 0, 8+len(item.Value))
+	value = append(value, MEMCACHEHA_HEADER...)
+	value = append(value, binExpiry...)
 	value = append(value, item.Value...)
 
 	return &memcache.Item{
@@ -98,3 +481,108 @@ func (item *Item) AsMemcacheItem() *memcache.Item {
 		Expiration: mcExpiry,
 	}
 }
+
+// encryptionAdditionalData returns the data authenticated with an encrypted value: the key, and the versioned header
+// version, flags and fields up to the key ID field. Later fields, such as the checksum of the encrypted value, are not
+// authenticated.
+func encryptionAdditionalData(key string, flags byte, fields []byte) []byte {
+	data := make([]byte, 0, 1+len(key)+len(MEMCACHEHA_VERSIONED_HEADER)+2+len(fields))
+	data = append(data, byte(len(key)))
+	data = append(data, key...)
+	data = append(data, MEMCACHEHA_VERSIONED_HEADER...)
+	data = append(data, HEADER_VERSION, flags)
+	return append(data, fields...)
+}
+
+// memcacheExpiration returns the expiration in seconds to send to memcached for the given absolute expiry time
+func memcacheExpiration(expiration time.Time) int32 {
+	// Change to relative for memcached
+	seconds := expiration.Unix() - time.Now().Unix()
+
+	// Catch negative offset (expire now)
+	if seconds < 1 {
+		return 1
+	}
+
+	// Longer expiries must be absolute
+	if seconds <= MEMCACHE_MAX_RELATIVE_EXPIRY {
+		return int32(seconds)
+	}
+	if expiration.Unix() <= math.MaxInt32 {
+		return int32(expiration.Unix())
+	}
+
+	// memcached cannot represent the expiry time, never expire. Expired items are treated as misses when read.
+	return 0
+}
+
+// expired returns true if this item has an expiry time that has passed
+func (item *Item) expired() bool {
+	return item.Expiration != nil && !item.Expiration.After(time.Now())
+}
+
+// appendHeaderField appends a versioned header field with the given type and data to fields
+func appendHeaderField(fields []byte, fieldType byte, data []byte) []byte {
+	fields = append(fields, fieldType, byte(len(data)))
+	return append(fields, data...)
+}
+
+// equal returns true if the given item has the same value, flags, timestamp and expiration as this item
+func (item *Item) equal(other *Item) bool {
+	if item.Flags != other.Flags || item.tombstone != other.tombstone || item.chunked != other.chunked || item.codec != other.codec || !bytes.Equal(item.Value, other.Value) {
+		return false
+	}
+	if !item.Timestamp.Equal(other.Timestamp) {
+		return false
+	}
+	if item.Expiration == nil || other.Expiration == nil {
+		return item.Expiration == other.Expiration
+	}
+	return item.Expiration.Equal(*other.Expiration)
+}
+
+// newerThan returns true if this item was written after the given item. Items without a timestamp are older than items
+// with one, and a tombstone is newer than an item with the same timestamp.
+func (item *Item) newerThan(other *Item) bool {
+	if item.Timestamp.Equal(other.Timestamp) {
+		return item.tombstone && !other.tombstone
+	}
+	return item.Timestamp.After(other.Timestamp)
+}
+
+// withKey returns this item, or a copy of it with the given key if different
+func (item *Item) withKey(key string) *Item {
+	if item.Key == key {
+		return item
+	}
+	copied := *item
+	copied.Key = key
+	return &copied
+}
+
+// applied returns true if the read-modify-write operation with the given id has been applied to this item
+func (item *Item) applied(operation uint64) bool {
+	for _, applied := range item.operations {
+		if applied == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// addOperation records the read-modify-write operation with the given id as applied to this item, dropping the oldest
+// beyond OPERATION_HISTORY_LENGTH
+func (item *Item) addOperation(operation uint64) {
+	operations := append(append([]uint64{}, item.operations...), operation)
+	if len(operations) > OPERATION_HISTORY_LENGTH {
+		operations = operations[len(operations)-OPERATION_HISTORY_LENGTH:]
+	}
+	item.operations = operations
+}
+
+// withTimestamp returns a copy of this item with the given write timestamp
+func (item *Item) withTimestamp(timestamp time.Time) *Item {
+	stamped := *item
+	stamped.Timestamp = timestamp
+	return &stamped
+}
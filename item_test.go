@@ -1 +1,464 @@
 package memcacheha
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func TestItemRoundTrip(t *testing.T) {
+	expiry := time.Unix(time.Now().Add(time.Hour).Unix(), 0)
+	item := &Item{Key: "foo", Value: []byte("bar"), Flags: 42, Expiration: &expiry}
+
+	mcItem := item.AsMemcacheItem()
+	if !bytes.Equal(mcItem.Value[:4], MEMCACHEHA_VERSIONED_HEADER) {
+		t.Fatalf("expected header %x, got %x", MEMCACHEHA_VERSIONED_HEADER, mcItem.Value[:4])
+	}
+
+	out, err := NewItemFromMemcacheItem(mcItem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !item.equal(out) {
+		t.Errorf("expected %+v, got %+v", item, out)
+	}
+	if out.tombstone {
+		t.Error("expected item not to be a tombstone")
+	}
+}
+
+func TestItemTombstoneRoundTrip(t *testing.T) {
+	tombstone := newTombstone("foo", time.Now().Add(time.Minute))
+
+	mcItem := tombstone.AsMemcacheItem()
+	if !bytes.Equal(mcItem.Value[:4], MEMCACHEHA_VERSIONED_HEADER) {
+		t.Fatalf("expected header %x, got %x", MEMCACHEHA_VERSIONED_HEADER, mcItem.Value[:4])
+	}
+
+	out, err := NewItemFromMemcacheItem(mcItem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !out.tombstone {
+		t.Error("expected item to be a tombstone")
+	}
+	if len(out.Value) != 0 {
+		t.Errorf("expected empty value, got %x", out.Value)
+	}
+}
+
+func TestNewItemFromMemcacheItemNotMemcacheHA(t *testing.T) {
+	for _, value := range [][]byte{
+		[]byte("bar"),
+		[]byte("not a memcacheha value"),
+		{0xfd, 0x37, 0xd3, 0x1c, 0, 0, 0, 0},
+	} {
+		_, err := NewItemFromMemcacheItem(&memcache.Item{Key: "foo", Value: value})
+		if err != ErrNotMemcacheHAKey {
+			t.Errorf("%x: expected ErrNotMemcacheHAKey, got %v", value, err)
+		}
+	}
+}
+
+func TestItemTimestampRoundTrip(t *testing.T) {
+	item := (&Item{Key: "foo", Value: []byte("bar")}).withTimestamp(time.Now())
+
+	mcItem := item.AsMemcacheItem()
+	if !bytes.Equal(mcItem.Value[:4], MEMCACHEHA_VERSIONED_HEADER) {
+		t.Fatalf("expected header %x, got %x", MEMCACHEHA_VERSIONED_HEADER, mcItem.Value[:4])
+	}
+
+	out, err := NewItemFromMemcacheItem(mcItem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !item.equal(out) {
+		t.Errorf("expected %+v, got %+v", item, out)
+	}
+}
+
+func TestItemNewerThan(t *testing.T) {
+	now := time.Now()
+	legacy := &Item{Key: "foo", Value: []byte("legacy")}
+	older := (&Item{Key: "foo", Value: []byte("older")}).withTimestamp(now.Add(-time.Second))
+	newer := (&Item{Key: "foo", Value: []byte("newer")}).withTimestamp(now)
+	tombstone := newTombstone("foo", now.Add(time.Minute)).withTimestamp(now)
+
+	if !older.newerThan(legacy) || legacy.newerThan(older) {
+		t.Error("expected timestamped item to be newer than legacy item")
+	}
+	if !newer.newerThan(older) || older.newerThan(newer) {
+		t.Error("expected newer item to be newer than older item")
+	}
+	if !tombstone.newerThan(newer) || newer.newerThan(tombstone) {
+		t.Error("expected tombstone to be newer than item with the same timestamp")
+	}
+}
+
+func TestNewItemFromMemcacheItemOriginalHeader(t *testing.T) {
+	value := []byte{0xfd, 0x37, 0xd3, 0x1b, 0x5a, 0x00, 0x00, 0x00, 'b', 'a', 'r'}
+
+	out, err := NewItemFromMemcacheItem(&memcache.Item{Key: "foo", Value: value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out.Value) != "bar" {
+		t.Errorf("expected value bar, got %q", out.Value)
+	}
+	if out.Expiration == nil || out.Expiration.Unix() != 0x5a000000 {
+		t.Errorf("expected expiry %d, got %v", 0x5a000000, out.Expiration)
+	}
+	if !out.Timestamp.IsZero() || out.tombstone {
+		t.Errorf("expected no timestamp or tombstone, got %+v", out)
+	}
+}
+
+func TestNewItemFromMemcacheItemVersionedHeaderUnknownField(t *testing.T) {
+	value := append([]byte{}, MEMCACHEHA_VERSIONED_HEADER...)
+	value = append(value, HEADER_VERSION, 0x00, 0x00, 0x09)
+	value = append(value, 0xff, 0x01, 0x00)
+	value = append(value, HEADER_FIELD_EXPIRY, 0x04, 0x5a, 0x00, 0x00, 0x00)
+	value = append(value, 'b', 'a', 'r')
+
+	out, err := NewItemFromMemcacheItem(&memcache.Item{Key: "foo", Value: value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out.Value) != "bar" {
+		t.Errorf("expected value bar, got %q", out.Value)
+	}
+	if out.Expiration == nil || out.Expiration.Unix() != 0x5a000000 {
+		t.Errorf("expected expiry %d, got %v", 0x5a000000, out.Expiration)
+	}
+}
+
+func TestNewItemFromMemcacheItemVersionedHeaderUnknownFlag(t *testing.T) {
+	value := append([]byte{}, MEMCACHEHA_VERSIONED_HEADER...)
+	value = append(value, HEADER_VERSION, HEADER_FLAG_TOMBSTONE|0x40, 0x00, 0x00)
+
+	out, err := NewItemFromMemcacheItem(&memcache.Item{Key: "foo", Value: value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !out.tombstone {
+		t.Error("expected item to be a tombstone")
+	}
+}
+
+func TestNewItemFromMemcacheItemVersionedHeaderUnsupported(t *testing.T) {
+	for _, header := range [][]byte{
+		{HEADER_VERSION + 1, 0x00, 0x00, 0x00},
+		{HEADER_VERSION, HEADER_FLAG_MUST_UNDERSTAND | 0x40, 0x00, 0x00},
+	} {
+		value := append(append([]byte{}, MEMCACHEHA_VERSIONED_HEADER...), header...)
+		_, err := NewItemFromMemcacheItem(&memcache.Item{Key: "foo", Value: value})
+		if err != ErrUnsupportedHeader {
+			t.Errorf("%x: expected ErrUnsupportedHeader, got %v", value, err)
+		}
+	}
+}
+
+func TestItemMustUnderstand(t *testing.T) {
+	keys, err := NewKeyRing("key", map[string][]byte{"key": bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressible := bytes.Repeat([]byte("compressible "), 100)
+
+	for _, test := range []struct {
+		item           *Item
+		encoding       *Encoding
+		flag           byte
+		mustUnderstand bool
+	}{
+		{&Item{Key: "foo", Value: []byte("bar")}, nil, 0, false},
+		{newTombstone("foo", time.Now().Add(time.Minute)), nil, HEADER_FLAG_TOMBSTONE, false},
+		{&Item{Key: "foo", Value: compressible}, &Encoding{Compressor: &GzipCompressor{Level: 9}}, HEADER_FLAG_COMPRESSED, true},
+		{&Item{Key: "foo", Value: []byte("bar")}, &Encoding{Keys: keys}, HEADER_FLAG_ENCRYPTED, true},
+		{&Item{Key: "foo", Value: []byte("manifest"), chunked: true}, nil, HEADER_FLAG_CHUNKED, true},
+	} {
+		mcItem, err := test.item.encode(test.encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		flags := mcItem.Value[5]
+		if flags&test.flag != test.flag || (flags&HEADER_FLAG_MUST_UNDERSTAND != 0) != test.mustUnderstand {
+			t.Errorf("expected flags %#x with must understand %t, got %#x", test.flag, test.mustUnderstand, flags)
+		}
+		if _, err := decodeItem(mcItem, test.encoding); err != nil {
+			t.Errorf("flags %#x: %v", flags, err)
+		}
+	}
+}
+
+func TestItemLegacyHeader(t *testing.T) {
+	encoding := &Encoding{LegacyHeader: true}
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	for _, expiration := range []*time.Time{nil, &expiry} {
+		item := &Item{Key: "foo", Value: []byte("bar"), Expiration: expiration, Timestamp: time.Now()}
+		mcItem, err := item.encode(encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(mcItem.Value[:4], MEMCACHEHA_HEADER) || len(mcItem.Value) != 8+len(item.Value) {
+			t.Fatalf("expected original header, got %x", mcItem.Value)
+		}
+		if expiration != nil && mcItem.Expiration != 3600 {
+			t.Errorf("expected memcache expiration 3600, got %d", mcItem.Expiration)
+		}
+
+		out, err := NewItemFromMemcacheItem(mcItem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out.Value) != "bar" || !out.Timestamp.IsZero() {
+			t.Errorf("expected bar without timestamp, got %+v", out)
+		}
+		if (expiration == nil) != (out.Expiration == nil) || (expiration != nil && !out.Expiration.Equal(*expiration)) {
+			t.Errorf("expected expiry %v, got %v", expiration, out.Expiration)
+		}
+	}
+
+	// Items that need the versioned header are still written with it
+	for _, test := range []struct {
+		item     *Item
+		encoding *Encoding
+	}{
+		{newTombstone("foo", expiry), encoding},
+		{&Item{Key: "foo", Value: []byte("manifest"), chunked: true}, encoding},
+		{&Item{Key: "foo", Value: []byte("bar"), codec: "json"}, encoding},
+		{&Item{Key: "foo", Value: []byte("bar")}, &Encoding{LegacyHeader: true, Checksum: true}},
+	} {
+		mcItem, err := test.item.encode(test.encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(mcItem.Value[:4], MEMCACHEHA_VERSIONED_HEADER) {
+			t.Errorf("expected versioned header for %+v, got %x", test.item, mcItem.Value)
+		}
+	}
+}
+
+func TestItemExpiryAfter2038(t *testing.T) {
+	expiry := time.Date(2100, 1, 2, 3, 4, 5, 6e6, time.UTC)
+	item := &Item{Key: "foo", Value: []byte("bar"), Expiration: &expiry}
+
+	mcItem := item.AsMemcacheItem()
+	if mcItem.Expiration != 0 {
+		t.Errorf("expected memcache expiration 0, got %d", mcItem.Expiration)
+	}
+
+	out, err := NewItemFromMemcacheItem(mcItem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Expiration == nil || !out.Expiration.Equal(expiry) {
+		t.Errorf("expected expiry %s, got %v", expiry, out.Expiration)
+	}
+}
+
+func TestMemcacheExpiration(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		expiration time.Time
+		expected   int32
+	}{
+		{now.Add(-time.Minute), 1},
+		{now.Add(time.Hour), 3600},
+		{now.Add(60 * 24 * time.Hour), int32(now.Add(60 * 24 * time.Hour).Unix())},
+		{time.Unix(math.MaxInt32+1, 0), 0},
+	}
+	for _, test := range tests {
+		// Allow for the clock ticking over a second for relative expiries
+		actual := memcacheExpiration(test.expiration)
+		if actual != test.expected && actual != test.expected-1 {
+			t.Errorf("%s: expected %d, got %d", test.expiration, test.expected, actual)
+		}
+	}
+}
+
+func TestItemChecksum(t *testing.T) {
+	item := &Item{Key: "foo", Value: []byte("bar")}
+
+	mcItem, err := item.encode(&Encoding{Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewItemFromMemcacheItem(mcItem); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a bit in the value
+	mcItem.Value[len(mcItem.Value)-1] ^= 0x01
+	if _, err := NewItemFromMemcacheItem(mcItem); err != ErrChecksumMismatch {
+		t.Errorf("expected ErrChecksumMismatch, got %v", err)
+	}
+
+	// Truncate the value
+	mcItem.Value = mcItem.Value[:len(mcItem.Value)-1]
+	if _, err := NewItemFromMemcacheItem(mcItem); err != ErrChecksumMismatch {
+		t.Errorf("expected ErrChecksumMismatch, got %v", err)
+	}
+}
+
+func TestItemCompression(t *testing.T) {
+	encoding := &Encoding{Checksum: true, Compressor: &GzipCompressor{Level: 9}, CompressThreshold: 16}
+
+	for _, value := range [][]byte{
+		[]byte("short"),
+		bytes.Repeat([]byte("compressible "), 100),
+	} {
+		item := &Item{Key: "foo", Value: value}
+		mcItem, err := item.encode(encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed := mcItem.Value[5]&HEADER_FLAG_COMPRESSED != 0
+		if compressed != (len(value) >= encoding.CompressThreshold) {
+			t.Errorf("%d bytes: expected compressed to be %t", len(value), !compressed)
+		}
+		if compressed && len(mcItem.Value) >= len(value) {
+			t.Errorf("%d bytes: expected compressed value to be smaller, got %d bytes", len(value), len(mcItem.Value))
+		}
+
+		out, err := NewItemFromMemcacheItem(mcItem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Value, value) {
+			t.Errorf("expected %q, got %q", value, out.Value)
+		}
+	}
+}
+
+func TestItemEncryption(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	oldKeys, err := NewKeyRing("old", map[string][]byte{"old": oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotatedKeys, err := NewKeyRing("new", map[string][]byte{"old": oldKey, "new": newKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item := &Item{Key: "foo", Value: []byte("secret")}
+	mcItem, err := item.encode(&Encoding{Keys: oldKeys, Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(mcItem.Value, item.Value) {
+		t.Errorf("expected value to be encrypted, got %q", mcItem.Value)
+	}
+
+	// Values encrypted with the old key are read after rotation
+	out, err := decodeItem(mcItem, &Encoding{Keys: rotatedKeys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Value, item.Value) {
+		t.Errorf("expected %q, got %q", item.Value, out.Value)
+	}
+
+	if _, err := NewItemFromMemcacheItem(mcItem); err != ErrUnknownKeyID {
+		t.Errorf("expected ErrUnknownKeyID without keys, got %v", err)
+	}
+
+	// The value is bound to its key
+	mcItem.Key = "bar"
+	if _, err := decodeItem(mcItem, &Encoding{Keys: rotatedKeys}); err != ErrDecryptionFailed {
+		t.Errorf("expected ErrDecryptionFailed for a different key, got %v", err)
+	}
+}
+
+func TestItemEncryptionHeader(t *testing.T) {
+	keys, err := NewKeyRing("key", map[string][]byte{"key": bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoding := &Encoding{Keys: keys}
+
+	item := &Item{Key: "foo", Value: []byte("secret"), Timestamp: time.Now()}
+	mcItem, err := item.encode(encoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeItem(mcItem, encoding); err != nil {
+		t.Fatal(err)
+	}
+
+	// The value is bound to its header, so flags and fields cannot be changed
+	for _, offset := range []int{5, 10, 17} {
+		value := append([]byte{}, mcItem.Value...)
+		value[offset] ^= HEADER_FLAG_TOMBSTONE
+		if _, err := decodeItem(&memcache.Item{Key: "foo", Value: value}, encoding); err != ErrDecryptionFailed {
+			t.Errorf("byte %d: expected ErrDecryptionFailed, got %v", offset, err)
+		}
+	}
+}
+
+func TestItemRaw(t *testing.T) {
+	encoding := &Encoding{RawKeyPrefixes: []string{"shared:"}}
+
+	item := &Item{Key: "shared:foo", Value: []byte("bar"), Flags: 1}
+	mcItem, err := item.encode(encoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mcItem.Value, item.Value) {
+		t.Errorf("expected raw value %q, got %q", item.Value, mcItem.Value)
+	}
+	out, err := decodeItem(mcItem, encoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Value, item.Value) || out.Flags != item.Flags || out.raw {
+		t.Errorf("expected %+v, got %+v", item, out)
+	}
+
+	// Other keys have a header
+	mcItem, err = (&Item{Key: "foo", Value: []byte("bar")}).encode(encoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(mcItem.Value, MEMCACHEHA_VERSIONED_HEADER) {
+		t.Errorf("expected header, got %q", mcItem.Value)
+	}
+}
+
+func TestItemAcceptRaw(t *testing.T) {
+	mcItem := &memcache.Item{Key: "foo", Value: []byte("bar")}
+	if _, err := decodeItem(mcItem, &Encoding{}); err != ErrNotMemcacheHAKey {
+		t.Errorf("expected ErrNotMemcacheHAKey, got %v", err)
+	}
+	out, err := decodeItem(mcItem, &Encoding{AcceptRaw: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Value, mcItem.Value) || !out.raw {
+		t.Errorf("expected raw item %q, got %+v", mcItem.Value, out)
+	}
+}
+
+func TestItemOperations(t *testing.T) {
+	item := &Item{Key: "foo", Value: []byte("1")}
+	for operation := uint64(1); operation <= OPERATION_HISTORY_LENGTH+1; operation++ {
+		item.addOperation(operation)
+	}
+
+	// The oldest operation is dropped beyond the history length
+	if len(item.operations) != OPERATION_HISTORY_LENGTH || item.applied(1) || !item.applied(2) {
+		t.Errorf("expected the last %d operations, got %v", OPERATION_HISTORY_LENGTH, item.operations)
+	}
+
+	out, err := NewItemFromMemcacheItem(item.AsMemcacheItem())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.operations) != OPERATION_HISTORY_LENGTH || !out.applied(OPERATION_HISTORY_LENGTH+1) || out.applied(1) {
+		t.Errorf("expected %v, got %v", item.operations, out.operations)
+	}
+}
@@ -0,0 +1,86 @@
+package memcacheha
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// MAX_KEY_LENGTH is the longest key memcached accepts
+const MAX_KEY_LENGTH = 250
+
+// KeyTransformer returns the key to store a value under for the given key, e.g. HashLongKeys
+type KeyTransformer func(key string) string
+
+// HashLongKeys is a KeyTransformer that replaces keys longer than MAX_KEY_LENGTH with a readable prefix of the key,
+// followed by '#' and the hex SHA-256 hash of the whole key. Other keys are not changed.
+func HashLongKeys(key string) string {
+	if len(key) <= MAX_KEY_LENGTH {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	prefixLength := MAX_KEY_LENGTH - 1 - hex.EncodedLen(len(sum))
+	return key[:prefixLength] + "#" + hex.EncodeToString(sum[:])
+}
+
+// KeyError is an error meaning the given key cannot be sent to memcached
+type KeyError struct {
+	Key string
+	Err error
+}
+
+func (err *KeyError) Error() string {
+	return err.Err.Error() + ": " + err.Key
+}
+
+func (err *KeyError) Unwrap() error {
+	return err.Err
+}
+
+// validateKey returns a KeyError if the given key is not a valid memcache key
+func validateKey(key string) error {
+	if len(key) == 0 {
+		return &KeyError{Key: key, Err: ErrEmptyKey}
+	}
+	if len(key) > MAX_KEY_LENGTH {
+		return &KeyError{Key: key, Err: ErrKeyTooLong}
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return &KeyError{Key: key, Err: ErrKeyInvalidCharacter}
+		}
+	}
+	return nil
+}
+
+// storageKey returns the key to store a value for the given key under, after the KeyTransformer, or a KeyError if it is
+// not a valid memcache key
+func (client *Client) storageKey(key string) (string, error) {
+	if client.KeyTransformer != nil {
+		key = client.KeyTransformer(key)
+	}
+	if err := validateKey(key); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// storageItem returns the given item, or a copy of it with the key to store it under if that is different, as storageKey
+func (client *Client) storageItem(item *Item) (*Item, error) {
+	key, err := client.storageKey(item.Key)
+	if err != nil {
+		return nil, err
+	}
+	return item.withKey(key), nil
+}
+
+var (
+	// ErrEmptyKey is an error meaning a key is empty
+	ErrEmptyKey = errors.New("memcacheha: empty key")
+
+	// ErrKeyTooLong is an error meaning a key is longer than MAX_KEY_LENGTH
+	ErrKeyTooLong = errors.New("memcacheha: key too long")
+
+	// ErrKeyInvalidCharacter is an error meaning a key contains whitespace or control characters
+	ErrKeyInvalidCharacter = errors.New("memcacheha: key contains invalid character")
+)
@@ -0,0 +1,113 @@
+package memcacheha
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func TestValidateKey(t *testing.T) {
+	for key, expected := range map[string]error{
+		"foo":                    nil,
+		"https://example.com/x":  nil,
+		"":                       ErrEmptyKey,
+		strings.Repeat("x", 251): ErrKeyTooLong,
+		"foo bar":                ErrKeyInvalidCharacter,
+		"foo\nbar":               ErrKeyInvalidCharacter,
+		"foo\x7fbar":             ErrKeyInvalidCharacter,
+	} {
+		err := validateKey(key)
+		if !errors.Is(err, expected) || (expected == nil) != (err == nil) {
+			t.Errorf("%q: expected %v, got %v", key, expected, err)
+		}
+		var keyErr *KeyError
+		if err != nil && (!errors.As(err, &keyErr) || keyErr.Key != key) {
+			t.Errorf("%q: expected KeyError, got %v", key, err)
+		}
+	}
+}
+
+func TestHashLongKeys(t *testing.T) {
+	if key := HashLongKeys("foo"); key != "foo" {
+		t.Errorf("expected short key unchanged, got %q", key)
+	}
+
+	long := "https://example.com/" + strings.Repeat("x", 300)
+	key := HashLongKeys(long)
+	if err := validateKey(key); err != nil {
+		t.Errorf("expected valid key, got %v", err)
+	}
+	if len(key) != MAX_KEY_LENGTH || !strings.HasPrefix(key, "https://example.com/") {
+		t.Errorf("expected %d byte key with readable prefix, got %q", MAX_KEY_LENGTH, key)
+	}
+	if HashLongKeys(long+"y") == key {
+		t.Errorf("expected different keys for different long keys")
+	}
+}
+
+func TestAddKeyTransformer(t *testing.T) {
+	client, servers := newTestCluster(t, 2, WithKeyTransformer(func(key string) string { return "t:" + key }))
+
+	// One node already holds the key
+	existing, err := (&Item{Key: "t:foo", Value: []byte("old"), Timestamp: time.Now().Add(-time.Minute)}).encode(&client.Encoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Nodes.GetNodes()[servers[0].endpoint()].client.Set(existing); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Add(&Item{Key: "foo", Value: []byte("new")}); err != memcache.ErrNotStored {
+		t.Fatalf("expected ErrNotStored, got %v", err)
+	}
+
+	// The node that stored the item is restored to the existing value under the transformed key, before Add returns
+	for _, server := range servers {
+		value, _ := server.value("t:foo")
+		item, err := decodeItem(&memcache.Item{Key: "t:foo", Value: value}, &client.Encoding)
+		if err != nil || string(item.Value) != "old" {
+			t.Errorf("expected old on %s, got %+v (%v)", server.endpoint(), item, err)
+		}
+		if server.keys() != 1 {
+			t.Errorf("expected only the transformed key on %s, got %d keys", server.endpoint(), server.keys())
+		}
+	}
+	item, err := client.Get("foo")
+	if err != nil || string(item.Value) != "old" {
+		t.Errorf("expected the existing value to survive, got %+v (%v)", item, err)
+	}
+}
+
+func TestGetMultiKeys(t *testing.T) {
+	client, _ := newTestCluster(t, 2, WithKeyTransformer(strings.ToLower))
+	if err := client.Set(&Item{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An invalid key fails the read before any node is read
+	items, err := client.GetMulti([]string{"foo", "bad key"})
+	if !errors.Is(err, ErrKeyInvalidCharacter) || items != nil {
+		t.Errorf("expected ErrKeyInvalidCharacter, got %v, %v", items, err)
+	}
+
+	// Keys read under the same key are each returned
+	items, err = client.GetMulti([]string{"foo", "FOO", "foo", "baz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items["foo"] == nil || items["FOO"] == nil || items["FOO"].Key != "FOO" {
+		t.Errorf("expected foo and FOO, got %v", items)
+	}
+
+	// Nodes failing to respond is an error, not a miss
+	source := &testNodeSource{nodes: []string{"127.0.0.1:1"}}
+	unreachable := New(WithLogger(testLogger{}), WithSources(source))
+	unreachable.GetNodes()
+	unreachable.Nodes.GetNodes()["127.0.0.1:1"].markHealthy()
+	if items, err := unreachable.GetMulti([]string{"foo"}); err == nil {
+		t.Errorf("expected error from unreachable node, got %v", items)
+	}
+}
@@ -41,3 +41,11 @@ func (sl *scopedLogger) Info(message string, args ...interface{}) {
 func (sl *scopedLogger) Debug(message string, args ...interface{}) {
 	sl.l.Debug(sl.prefix+": "+message, args...)
 }
+
+// nopLogger discards all logs, it is the Logger of a Client created without WithLogger
+type nopLogger struct{}
+
+func (nopLogger) Error(message string, args ...interface{}) {}
+func (nopLogger) Warn(message string, args ...interface{})  {}
+func (nopLogger) Info(message string, args ...interface{})  {}
+func (nopLogger) Debug(message string, args ...interface{}) {}
@@ -0,0 +1,78 @@
+package memcacheha
+
+import (
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Metrics records instrumentation from a Client and its Nodes, set with WithMetrics. Methods are called concurrently,
+// from the goroutine of each operation, and must not block. See the prometheus sub-package for a Prometheus collector.
+type Metrics interface {
+	// ObserveOperation records the duration of a Client operation, and the error it returned
+	ObserveOperation(op string, duration time.Duration, err error)
+
+	// AddLookups records the number of keys found and missed by a read
+	AddLookups(op string, hits int, misses int)
+
+	// IncNodeError records an error from the node with the given endpoint, which is a transport error if it made the
+	// node unhealthy. Cache misses and failed conditions are not errors.
+	IncNodeError(endpoint string, err error, transport bool)
+
+	// AddRepairs records the number of nodes synchronised by an operation
+	AddRepairs(op string, nodes int)
+
+	// WatchNodes records the NodeList of the Client, to read the number of healthy nodes from when metrics are collected
+	WatchNodes(nodes *NodeList)
+
+	// IncDiscoveryError records an error from a NodeSource
+	IncDiscoveryError()
+}
+
+// nopMetrics discards all metrics, it is the Metrics of a Client created without WithMetrics
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveOperation(op string, duration time.Duration, err error) {}
+func (nopMetrics) AddLookups(op string, hits int, misses int)                    {}
+func (nopMetrics) IncNodeError(endpoint string, err error, transport bool)       {}
+func (nopMetrics) AddRepairs(op string, nodes int)                               {}
+func (nopMetrics) WatchNodes(nodes *NodeList)                                    {}
+func (nopMetrics) IncDiscoveryError()                                            {}
+
+// WithMetrics sets the Metrics of the Client. Without it, metrics are discarded.
+func WithMetrics(metrics Metrics) Option {
+	return func(client *Client) {
+		client.Metrics = metrics
+	}
+}
+
+// observeLookup records a hit or miss for a read of a single key that returned the given error
+func (client *Client) observeLookup(op string, err *error) {
+	switch *err {
+	case nil:
+		client.Metrics.AddLookups(op, 1, 0)
+	case memcache.ErrCacheMiss:
+		client.Metrics.AddLookups(op, 0, 1)
+	}
+}
+
+// recordEvent records the metrics for the given Event, it is subscribed to the events of every Client
+func (client *Client) recordEvent(event Event) {
+	switch event.Type {
+	case EVENT_REPAIR_PERFORMED:
+		client.Metrics.AddRepairs(event.Op, event.Nodes)
+	case EVENT_SOURCE_ERROR:
+		client.Metrics.IncDiscoveryError()
+	}
+}
+
+// nodeFailed records an error from the given node, other than a cache miss or failed condition
+func (node *Node) nodeFailed(err error, transport bool) {
+	switch err {
+	case memcache.ErrCacheMiss, memcache.ErrCASConflict, memcache.ErrNotStored:
+		return
+	}
+	if node.metrics != nil {
+		node.metrics.IncNodeError(node.Endpoint, err, transport)
+	}
+}
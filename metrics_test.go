@@ -0,0 +1,88 @@
+package memcacheha
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testMetrics struct {
+	lock            sync.Mutex
+	operations      map[string]error
+	nodeErrors      map[string]bool
+	nodes           *NodeList
+	discoveryErrors int
+}
+
+func (metrics *testMetrics) ObserveOperation(op string, duration time.Duration, err error) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	metrics.operations[op] = err
+}
+
+func (metrics *testMetrics) AddLookups(op string, hits int, misses int) {}
+
+func (metrics *testMetrics) IncNodeError(endpoint string, err error, transport bool) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	metrics.nodeErrors[endpoint] = transport
+}
+
+func (metrics *testMetrics) AddRepairs(op string, nodes int) {}
+
+func (metrics *testMetrics) WatchNodes(nodes *NodeList) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	metrics.nodes = nodes
+}
+
+func (metrics *testMetrics) IncDiscoveryError() {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	metrics.discoveryErrors++
+}
+
+func TestClientMetrics(t *testing.T) {
+	metrics := &testMetrics{operations: map[string]error{}, nodeErrors: map[string]bool{}}
+	source := &testNodeSource{nodes: []string{"127.0.0.1:1"}}
+	client := New(WithLogger(testLogger{}), WithSources(source), WithMetrics(metrics))
+
+	metrics.lock.Lock()
+	nodes := metrics.nodes
+	metrics.lock.Unlock()
+	if nodes != client.Nodes {
+		t.Fatal("expected the nodes of the client to be watched")
+	}
+
+	client.GetNodes()
+	node := client.Nodes.GetNodes()["127.0.0.1:1"]
+	node.markHealthy()
+
+	node.getNodeResponse(nil, errors.New("timeout"))
+	metrics.lock.Lock()
+	transport, found := metrics.nodeErrors["127.0.0.1:1"]
+	metrics.lock.Unlock()
+	if !found || !transport {
+		t.Errorf("expected transport error for node, got found %t, transport %t", found, transport)
+	}
+
+	if _, err := client.Get("key"); err != ErrNoHealthyNodes {
+		t.Fatalf("expected ErrNoHealthyNodes, got %v", err)
+	}
+	metrics.lock.Lock()
+	err, found := metrics.operations["Get"]
+	metrics.lock.Unlock()
+	if !found || err != ErrNoHealthyNodes {
+		t.Errorf("expected Get to be observed with ErrNoHealthyNodes, got %v", err)
+	}
+
+	source.err = errors.New("unavailable")
+	client.GetNodes()
+	metrics.lock.Lock()
+	discoveryErrors := metrics.discoveryErrors
+	metrics.lock.Unlock()
+	if discoveryErrors != 1 {
+		t.Errorf("expected 1 discovery error, got %d", discoveryErrors)
+	}
+}
@@ -0,0 +1,385 @@
+package memcacheha
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// NAMESPACE_GENERATION_PREFIX prefixes the name of a namespace in the key holding its generation
+const NAMESPACE_GENERATION_PREFIX = "memcacheha:namespace:"
+
+// DEFAULT_GENERATION_TTL is the default time the generation of a namespace is cached for
+const DEFAULT_GENERATION_TTL = time.Second
+
+// ErrInvalidNamespace is an error meaning a namespace name is empty, or contains ':' or characters invalid in a key
+var ErrInvalidNamespace = errors.New("memcacheha: invalid namespace")
+
+// Namespace is a view of a Client that stores keys under the name and current generation of the namespace, as
+// name:generation:key. The generation is a counter stored in the cluster, so all keys in the namespace are invalidated at
+// once by Invalidate.
+type Namespace struct {
+	Client *Client
+	Name   string
+
+	// GenerationTTL is the time the generation is cached for, rather than read by every operation. Invalidate by other
+	// clients is seen once the cached generation expires. Zero reads the generation every time.
+	GenerationTTL time.Duration
+
+	lock             sync.Mutex
+	generation       uint64
+	generationExpiry time.Time
+}
+
+// NewNamespace returns a new Namespace with the given name, using the given Client
+func NewNamespace(client *Client, name string) (*Namespace, error) {
+	if strings.Contains(name, ":") || validateKey(name) != nil {
+		return nil, ErrInvalidNamespace
+	}
+	return &Namespace{
+		Client:        client,
+		Name:          name,
+		GenerationTTL: DEFAULT_GENERATION_TTL,
+	}, nil
+}
+
+// Generation returns the current generation of the namespace, starting a new generation if there is none
+func (namespace *Namespace) Generation() (uint64, error) {
+	return namespace.GenerationContext(context.Background())
+}
+
+// GenerationContext is like Generation, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (namespace *Namespace) GenerationContext(ctx context.Context) (uint64, error) {
+	if generation, found := namespace.cachedGeneration(); found {
+		return generation, nil
+	}
+
+	item, err := namespace.Client.GetContext(ctx, namespace.generationKey())
+	if err == memcache.ErrCacheMiss {
+		return namespace.startGeneration(ctx)
+	}
+	if err != nil {
+		return 0, err
+	}
+	generation, err := parseGeneration(item)
+	if err != nil {
+		return 0, err
+	}
+	namespace.cacheGeneration(generation)
+	return generation, nil
+}
+
+// cachedGeneration returns the cached generation, and whether it is cached and has not expired
+func (namespace *Namespace) cachedGeneration() (uint64, bool) {
+	namespace.lock.Lock()
+	defer namespace.lock.Unlock()
+	return namespace.generation, namespace.GenerationTTL > 0 && time.Now().Before(namespace.generationExpiry)
+}
+
+// cacheGeneration caches the given generation for GenerationTTL
+func (namespace *Namespace) cacheGeneration(generation uint64) {
+	namespace.lock.Lock()
+	defer namespace.lock.Unlock()
+	namespace.generation = generation
+	namespace.generationExpiry = time.Now().Add(namespace.GenerationTTL)
+}
+
+// Invalidate starts a new generation of the namespace, so that no key written in the namespace before is read.
+func (namespace *Namespace) Invalidate() error {
+	return namespace.InvalidateContext(context.Background())
+}
+
+// InvalidateContext is like Invalidate, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (namespace *Namespace) InvalidateContext(ctx context.Context) error {
+	generation, err := namespace.Client.IncrementContext(ctx, namespace.generationKey(), 1)
+	if err == memcache.ErrCacheMiss {
+		_, err = namespace.startGeneration(ctx)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	namespace.cacheGeneration(generation)
+	return nil
+}
+
+// startGeneration writes the first generation of the namespace, from the current time, so that it is newer than any
+// generation that was evicted. If another client started a generation first, that generation is returned.
+func (namespace *Namespace) startGeneration(ctx context.Context) (uint64, error) {
+	generation := uint64(time.Now().UnixNano())
+	err := namespace.Client.AddContext(ctx, &Item{
+		Key:   namespace.generationKey(),
+		Value: []byte(strconv.FormatUint(generation, 10)),
+	})
+	if err == memcache.ErrNotStored {
+		// Read from all nodes, as the generation may not be on the nodes read before
+		item, err := namespace.Client.GetForUpdateContext(ctx, namespace.generationKey())
+		if err != nil {
+			return 0, err
+		}
+		generation, err := parseGeneration(item)
+		if err != nil {
+			return 0, err
+		}
+		namespace.cacheGeneration(generation)
+		return generation, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	namespace.Client.Log.Info("Namespace %s: Started generation %d", namespace.Name, generation)
+	namespace.cacheGeneration(generation)
+	return generation, nil
+}
+
+// parseGeneration returns the generation held by the given item
+func parseGeneration(item *Item) (uint64, error) {
+	generation, err := strconv.ParseUint(string(item.Value), 10, 64)
+	if err != nil {
+		return 0, ErrNonNumericValue
+	}
+	return generation, nil
+}
+
+// generationKey returns the key holding the generation of the namespace
+func (namespace *Namespace) generationKey() string {
+	return NAMESPACE_GENERATION_PREFIX + namespace.Name
+}
+
+// prefix returns the prefix of keys in the current generation of the namespace
+func (namespace *Namespace) prefix(ctx context.Context) (string, error) {
+	generation, err := namespace.GenerationContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	return namespace.Name + ":" + strconv.FormatUint(generation, 10) + ":", nil
+}
+
+// item returns a copy of the given item with its key in the current generation of the namespace
+func (namespace *Namespace) item(ctx context.Context, item *Item) (*Item, error) {
+	prefix, err := namespace.prefix(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return item.withKey(prefix + item.Key), nil
+}
+
+// Add writes the given item in the namespace, as Client.Add
+func (namespace *Namespace) Add(item *Item) error {
+	return namespace.AddContext(context.Background(), item)
+}
+
+// AddContext is like Add, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (namespace *Namespace) AddContext(ctx context.Context, item *Item) error {
+	item, err := namespace.item(ctx, item)
+	if err != nil {
+		return err
+	}
+	return namespace.Client.AddContext(ctx, item)
+}
+
+// Replace writes the given item in the namespace, as Client.Replace
+func (namespace *Namespace) Replace(item *Item) error {
+	return namespace.ReplaceContext(context.Background(), item)
+}
+
+// ReplaceContext is like Replace, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (namespace *Namespace) ReplaceContext(ctx context.Context, item *Item) error {
+	item, err := namespace.item(ctx, item)
+	if err != nil {
+		return err
+	}
+	return namespace.Client.ReplaceContext(ctx, item)
+}
+
+// Set writes the given item in the namespace, as Client.Set
+func (namespace *Namespace) Set(item *Item) error {
+	return namespace.SetContext(context.Background(), item)
+}
+
+// SetContext is like Set, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (namespace *Namespace) SetContext(ctx context.Context, item *Item) error {
+	item, err := namespace.item(ctx, item)
+	if err != nil {
+		return err
+	}
+	return namespace.Client.SetContext(ctx, item)
+}
+
+// Get gets the item for the given key in the namespace, as Client.Get
+func (namespace *Namespace) Get(key string) (*Item, error) {
+	return namespace.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (namespace *Namespace) GetContext(ctx context.Context, key string) (*Item, error) {
+	prefix, err := namespace.prefix(ctx)
+	if err != nil {
+		return nil, err
+	}
+	item, err := namespace.Client.GetContext(ctx, prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	return item.withKey(key), nil
+}
+
+// GetMulti gets the items for the given keys in the namespace, as Client.GetMulti
+func (namespace *Namespace) GetMulti(keys []string) (map[string]*Item, error) {
+	return namespace.GetMultiContext(context.Background(), keys)
+}
+
+// GetMultiContext is like GetMulti, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (namespace *Namespace) GetMultiContext(ctx context.Context, keys []string) (map[string]*Item, error) {
+	prefix, err := namespace.prefix(ctx)
+	if err != nil {
+		return nil, err
+	}
+	prefixedKeys := make([]string, len(keys))
+	for i, key := range keys {
+		prefixedKeys[i] = prefix + key
+	}
+	items, err := namespace.Client.GetMultiContext(ctx, prefixedKeys)
+	if items == nil {
+		return nil, err
+	}
+	namespacedItems := map[string]*Item{}
+	for key, item := range items {
+		key = strings.TrimPrefix(key, prefix)
+		namespacedItems[key] = item.withKey(key)
+	}
+	return namespacedItems, err
+}
+
+// GetForUpdate gets the item for the given key in the namespace, as Client.GetForUpdate
+func (namespace *Namespace) GetForUpdate(key string) (*Item, error) {
+	return namespace.GetForUpdateContext(context.Background(), key)
+}
+
+// GetForUpdateContext is like GetForUpdate, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (namespace *Namespace) GetForUpdateContext(ctx context.Context, key string) (*Item, error) {
+	prefix, err := namespace.prefix(ctx)
+	if err != nil {
+		return nil, err
+	}
+	item, err := namespace.Client.GetForUpdateContext(ctx, prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	return item.withKey(key), nil
+}
+
+// CompareAndSwap writes the given item returned by GetForUpdate in the namespace, as Client.CompareAndSwap
+func (namespace *Namespace) CompareAndSwap(item *Item) error {
+	return namespace.CompareAndSwapContext(context.Background(), item)
+}
+
+// CompareAndSwapContext is like CompareAndSwap, but returns ctx.Err() if ctx is done before all nodes have responded.
+// ErrCASConflict is returned if the namespace was invalidated since the item was read.
+func (namespace *Namespace) CompareAndSwapContext(ctx context.Context, item *Item) error {
+	item, err := namespace.item(ctx, item)
+	if err != nil {
+		return err
+	}
+
+	// The item must be swapped in the generation it was read from
+	key, err := namespace.Client.storageKey(item.Key)
+	if err != nil {
+		return err
+	}
+	for _, casItem := range item.casItems {
+		if casItem.Key != key {
+			return memcache.ErrCASConflict
+		}
+	}
+	return namespace.Client.CompareAndSwapContext(ctx, item)
+}
+
+// Append appends the value of the given item in the namespace, as Client.Append
+func (namespace *Namespace) Append(item *Item) error {
+	return namespace.AppendContext(context.Background(), item)
+}
+
+// AppendContext is like Append, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (namespace *Namespace) AppendContext(ctx context.Context, item *Item) error {
+	item, err := namespace.item(ctx, item)
+	if err != nil {
+		return err
+	}
+	return namespace.Client.AppendContext(ctx, item)
+}
+
+// Prepend prepends the value of the given item in the namespace, as Client.Prepend
+func (namespace *Namespace) Prepend(item *Item) error {
+	return namespace.PrependContext(context.Background(), item)
+}
+
+// PrependContext is like Prepend, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (namespace *Namespace) PrependContext(ctx context.Context, item *Item) error {
+	item, err := namespace.item(ctx, item)
+	if err != nil {
+		return err
+	}
+	return namespace.Client.PrependContext(ctx, item)
+}
+
+// Increment increments the value for the given key in the namespace, as Client.Increment
+func (namespace *Namespace) Increment(key string, delta uint64) (uint64, error) {
+	return namespace.IncrementContext(context.Background(), key, delta)
+}
+
+// IncrementContext is like Increment, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (namespace *Namespace) IncrementContext(ctx context.Context, key string, delta uint64) (uint64, error) {
+	prefix, err := namespace.prefix(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return namespace.Client.IncrementContext(ctx, prefix+key, delta)
+}
+
+// Decrement decrements the value for the given key in the namespace, as Client.Decrement
+func (namespace *Namespace) Decrement(key string, delta uint64) (uint64, error) {
+	return namespace.DecrementContext(context.Background(), key, delta)
+}
+
+// DecrementContext is like Decrement, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (namespace *Namespace) DecrementContext(ctx context.Context, key string, delta uint64) (uint64, error) {
+	prefix, err := namespace.prefix(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return namespace.Client.DecrementContext(ctx, prefix+key, delta)
+}
+
+// Delete deletes the item for the given key in the namespace, as Client.Delete
+func (namespace *Namespace) Delete(key string) error {
+	return namespace.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Delete, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (namespace *Namespace) DeleteContext(ctx context.Context, key string) error {
+	prefix, err := namespace.prefix(ctx)
+	if err != nil {
+		return err
+	}
+	return namespace.Client.DeleteContext(ctx, prefix+key)
+}
+
+// Touch updates the expiry for the given key in the namespace, as Client.Touch
+func (namespace *Namespace) Touch(key string, seconds int32) error {
+	return namespace.TouchContext(context.Background(), key, seconds)
+}
+
+// TouchContext is like Touch, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (namespace *Namespace) TouchContext(ctx context.Context, key string, seconds int32) error {
+	prefix, err := namespace.prefix(ctx)
+	if err != nil {
+		return err
+	}
+	return namespace.Client.TouchContext(ctx, prefix+key, seconds)
+}
@@ -0,0 +1,185 @@
+package memcacheha
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func TestNewNamespace(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"sessions": true,
+		"":         false,
+		"a:b":      false,
+		"a b":      false,
+	} {
+		_, err := NewNamespace(New(WithLogger(testLogger{})), name)
+		if (err == nil) != valid {
+			t.Errorf("%q: expected valid %t, got %v", name, valid, err)
+		}
+	}
+}
+
+func TestNamespacePrefix(t *testing.T) {
+	client, servers := newTestCluster(t, 2)
+	namespace, err := NewNamespace(client, "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := namespace.Set(&Item{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+	generation, err := namespace.Generation()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys are stored under the name and generation, and returned with the key requested
+	key := "sessions:" + strconv.FormatUint(generation, 10) + ":foo"
+	for _, server := range servers {
+		if _, found := server.value(key); !found {
+			t.Errorf("expected %s on %s", key, server.endpoint())
+		}
+	}
+	item, err := namespace.Get("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Key != "foo" || string(item.Value) != "bar" {
+		t.Errorf("expected foo=bar, got %s=%s", item.Key, item.Value)
+	}
+	items, err := namespace.GetMulti([]string{"foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items["foo"] == nil || items["foo"].Key != "foo" {
+		t.Errorf("expected foo, got %v", items)
+	}
+	if _, err := client.Get("foo"); err != memcache.ErrCacheMiss {
+		t.Errorf("expected key outside the namespace to miss, got %v", err)
+	}
+}
+
+func TestNamespaceInvalidate(t *testing.T) {
+	client, _ := newTestCluster(t, 2)
+	namespace, _ := NewNamespace(client, "sessions")
+	other, _ := NewNamespace(client, "sessions")
+	other.GenerationTTL = 0
+	if err := namespace.Set(&Item{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Get("foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalidate makes old keys unreachable, for uncached namespaces at once
+	if err := namespace.Invalidate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []*Namespace{namespace, other} {
+		if _, err := n.Get("foo"); err != memcache.ErrCacheMiss {
+			t.Errorf("expected ErrCacheMiss after Invalidate, got %v", err)
+		}
+	}
+
+	// The cached generation is used until it expires
+	cached, _ := NewNamespace(client, "sessions")
+	before, err := cached.Generation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := namespace.Invalidate(); err != nil {
+		t.Fatal(err)
+	}
+	if generation, _ := cached.Generation(); generation != before {
+		t.Errorf("expected cached generation %d, got %d", before, generation)
+	}
+	cached.GenerationTTL = 0
+	if generation, _ := cached.Generation(); generation != before+1 {
+		t.Errorf("expected generation %d after expiry, got %d", before+1, generation)
+	}
+}
+
+func TestNamespaceStartGenerationRace(t *testing.T) {
+	client, servers := newTestCluster(t, 3)
+	endpoints := make([]string, len(servers))
+	for i, server := range servers {
+		endpoints[i] = server.endpoint()
+	}
+	other := New(WithLogger(testLogger{}), WithSources(NewStaticNodeSource(endpoints...)))
+	other.GetNodes()
+
+	// Clients starting the first generation at once agree on it
+	for attempt := 0; attempt < 10; attempt++ {
+		name := "race" + strconv.Itoa(attempt)
+		generations := make([]uint64, 2)
+		errs := make([]error, 2)
+		wait := sync.WaitGroup{}
+		for i, c := range []*Client{client, other} {
+			namespace, _ := NewNamespace(c, name)
+			wait.Add(1)
+			go func(i int) {
+				defer wait.Done()
+				generations[i], errs[i] = namespace.Generation()
+			}(i)
+		}
+		wait.Wait()
+		if errs[0] != nil || errs[1] != nil {
+			t.Fatalf("expected generations, got %v", errs)
+		}
+		if generations[0] != generations[1] {
+			t.Errorf("expected clients to agree on the generation, got %d and %d", generations[0], generations[1])
+		}
+	}
+
+	// A client losing the Add reads the generation started by the other
+	namespace, _ := NewNamespace(client, "started")
+	generation, err := namespace.Generation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	late, _ := NewNamespace(other, "started")
+	if started, err := late.startGeneration(context.Background()); err != nil || started != generation {
+		t.Errorf("expected generation %d, got %d (%v)", generation, started, err)
+	}
+}
+
+func TestNamespaceCompareAndSwapInvalidated(t *testing.T) {
+	client, _ := newTestCluster(t, 2)
+	namespace, _ := NewNamespace(client, "counters")
+	if err := namespace.Set(&Item{Key: "foo", Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	item, err := namespace.GetForUpdate("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A value written under the same key in the new generation is not swapped
+	if err := namespace.Invalidate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := namespace.Set(&Item{Key: "foo", Value: []byte("10")}); err != nil {
+		t.Fatal(err)
+	}
+	item.Value = []byte("2")
+	if err := namespace.CompareAndSwap(item); err != memcache.ErrCASConflict {
+		t.Errorf("expected ErrCASConflict, got %v", err)
+	}
+	if current, err := namespace.Get("foo"); err != nil || string(current.Value) != "10" {
+		t.Errorf("expected new generation value to be kept, got %+v (%v)", current, err)
+	}
+
+	// Items read in the current generation are swapped
+	item, err = namespace.GetForUpdate("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	item.Value = []byte("11")
+	if err := namespace.CompareAndSwap(item); err != nil {
+		t.Errorf("expected swap to succeed, got %v", err)
+	}
+}
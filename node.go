@@ -3,8 +3,10 @@ package memcacheha
 import (
 	"github.com/bradfitz/gomemcache/memcache"
 
+	"bytes"
 	"crypto/rand"
 	"fmt"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,20 +15,28 @@ type Node struct {
 	Endpoint string
 	Log      Logger
 
-	IsHealthy       bool
-	LastHealthCheck time.Time
+	Encoding *Encoding
 
-	client *memcache.Client
+	client           *memcache.Client
+	checksumFailures uint64
+	events           *eventBus
+	metrics          Metrics
+
+	// tombstones is true if the Client writes tombstones, so items must be read to check for them before they are
+	// replaced, deleted or touched
+	tombstones bool
+
+	// healthy and lastHealthCheck (UNIX nanoseconds) are updated by every operation, from many goroutines
+	healthy         atomic.Bool
+	lastHealthCheck atomic.Int64
 }
 
 // NewNode returns a new Node with the given Logger and endpoint (host:port)
 func NewNode(log Logger, endpoint string, timeout time.Duration) *Node {
 	node := &Node{
-		Endpoint:        endpoint,
-		Log:             newScopedLogger("Node "+endpoint, log),
-		IsHealthy:       false,
-		LastHealthCheck: time.Now().Add(-1 * HEALTHCHECK_PERIOD),
-		client:          memcache.New(endpoint),
+		Endpoint: endpoint,
+		Log:      newScopedLogger("Node "+endpoint, log),
+		client:   memcache.New(endpoint),
 	}
 	node.client.Timeout = timeout
 	return node
@@ -35,7 +45,7 @@ func NewNode(log Logger, endpoint string, timeout time.Duration) *Node {
 // Add an item to the memcache server represented by this node and send the response to the given channel
 func (node *Node) Add(item *Item, finishChan chan (*NodeResponse)) {
 	go func() {
-		if item.Expiration != nil && !item.Expiration.After(time.Now()) {
+		if item.expired() {
 			if finishChan != nil {
 				finishChan <- NewNodeResponse(node, nil, nil)
 			}
@@ -46,7 +56,16 @@ func (node *Node) Add(item *Item, finishChan chan (*NodeResponse)) {
 		} else {
 			node.Log.Debug("ADD %s", item.Key)
 		}
-		err := node.client.Add(item.AsMemcacheItem())
+		mcItem, err := item.encode(node.Encoding)
+		if err != nil {
+			node.encodeFailed(item, err, finishChan)
+			return
+		}
+		err = node.client.Add(mcItem)
+		if err == memcache.ErrNotStored {
+			// The existing value may be a tombstone, which does not prevent adding
+			err = node.addOverTombstone(mcItem)
+		}
 		if finishChan != nil {
 			finishChan <- node.getNodeResponse(nil, err)
 		}
@@ -56,7 +75,7 @@ func (node *Node) Add(item *Item, finishChan chan (*NodeResponse)) {
 // Set an item in the memcache server represented by this node and send the response to the given channel
 func (node *Node) Set(item *Item, finishChan chan (*NodeResponse)) {
 	go func() {
-		if item.Expiration != nil && !item.Expiration.After(time.Now()) {
+		if item.expired() {
 			if finishChan != nil {
 				finishChan <- NewNodeResponse(node, nil, nil)
 			}
@@ -67,7 +86,128 @@ func (node *Node) Set(item *Item, finishChan chan (*NodeResponse)) {
 		} else {
 			node.Log.Debug("SET %s", item.Key)
 		}
-		err := node.client.Set(item.AsMemcacheItem())
+		mcItem, err := item.encode(node.Encoding)
+		if err != nil {
+			node.encodeFailed(item, err, finishChan)
+			return
+		}
+		err = node.client.Set(mcItem)
+		if finishChan != nil {
+			finishChan <- node.getNodeResponse(nil, err)
+		}
+	}()
+}
+
+// CompareAndSwap an item in the memcache server represented by this node, using the CAS id previously read from this node, and send the response to the given channel
+func (node *Node) CompareAndSwap(item *Item, finishChan chan (*NodeResponse)) {
+	go func() {
+		casItem, found := item.casItems[node.Endpoint]
+		if !found {
+			if finishChan != nil {
+				finishChan <- NewNodeResponse(node, nil, ErrNoCASID)
+			}
+			return
+		}
+		if item.expired() {
+			if finishChan != nil {
+				finishChan <- NewNodeResponse(node, nil, nil)
+			}
+			return
+		}
+		node.Log.Debug("CAS %s", item.Key)
+
+		mcItem, err := item.encode(node.Encoding)
+		if err != nil {
+			node.encodeFailed(item, err, finishChan)
+			return
+		}
+
+		// Copy the CAS id from the item read from this node
+		swapItem := *casItem
+		swapItem.Value = mcItem.Value
+		swapItem.Flags = mcItem.Flags
+		swapItem.Expiration = mcItem.Expiration
+
+		err = node.client.CompareAndSwap(&swapItem)
+		if finishChan != nil {
+			finishChan <- node.getNodeResponse(nil, err)
+		}
+	}()
+}
+
+// RollBack restores the item previously read from this node in place of the given item written by CompareAndSwap, if the
+// node still holds it, and send the response to the given channel. ErrCASConflict is sent if the item was overwritten
+// since, in which case nothing is restored.
+func (node *Node) RollBack(item *Item, finishChan chan (*NodeResponse)) {
+	go func() {
+		node.Log.Debug("ROLLBACK %s", item.Key)
+		err := node.rollBack(item)
+		if finishChan != nil {
+			finishChan <- node.getNodeResponse(nil, err)
+		}
+	}()
+}
+
+// rollBack restores the item previously read from this node in place of the given item, see RollBack
+func (node *Node) rollBack(item *Item) error {
+	casItem, found := item.casItems[node.Endpoint]
+	if !found {
+		return ErrNoCASID
+	}
+	existing, err := node.client.Get(item.Key)
+	if err != nil {
+		return err
+	}
+
+	// Writes are identified by their timestamp and value
+	written, err := decodeItem(existing, node.Encoding)
+	if err != nil || !written.Timestamp.Equal(item.Timestamp) || !bytes.Equal(written.Value, item.Value) {
+		return memcache.ErrCASConflict
+	}
+
+	// memcached does not return the expiration, so it is read from the header
+	restored := *casItem
+	restored.CasID = existing.CasID
+	restored.Expiration = 0
+	if original, err := decodeItem(casItem, node.Encoding); err == nil && original.Expiration != nil {
+		restored.Expiration = memcacheExpiration(*original.Expiration)
+	}
+	return node.client.CompareAndSwap(&restored)
+}
+
+// Replace an item in the memcache server represented by this node and send the response to the given channel
+func (node *Node) Replace(item *Item, finishChan chan (*NodeResponse)) {
+	go func() {
+		if item.expired() {
+			if finishChan != nil {
+				finishChan <- NewNodeResponse(node, nil, nil)
+			}
+			return
+		}
+		if item.Expiration != nil {
+			node.Log.Debug("REPLACE %s Expire %s", item.Key, *item.Expiration)
+		} else {
+			node.Log.Debug("REPLACE %s", item.Key)
+		}
+		mcItem, err := item.encode(node.Encoding)
+		if err != nil {
+			node.encodeFailed(item, err, finishChan)
+			return
+		}
+		if node.tombstones {
+			// A tombstone is not replaced, as the key was deleted
+			err = node.swapLive(mcItem.Key, func(existing *memcache.Item) error {
+				existing.Value = mcItem.Value
+				existing.Flags = mcItem.Flags
+				existing.Expiration = mcItem.Expiration
+				return nil
+			})
+			if err == memcache.ErrCacheMiss {
+				err = memcache.ErrNotStored
+			}
+		} else {
+			err = node.client.Replace(mcItem)
+		}
 		if finishChan != nil {
 			finishChan <- node.getNodeResponse(nil, err)
 		}
@@ -85,11 +225,55 @@ func (node *Node) Get(key string, finishChan chan (*NodeResponse)) {
 	}()
 }
 
+// GetMulti gets the items with the given keys from the memcache server represented by this node and send the response to the given channel
+func (node *Node) GetMulti(keys []string, finishChan chan (*NodeResponse)) {
+	go func() {
+		node.Log.Debug("GETMULTI %d keys", len(keys))
+		items, err := node.client.GetMulti(keys)
+		if finishChan != nil {
+			finishChan <- node.getNodeMultiResponse(items, err)
+		}
+	}()
+}
+
 // Delete an item with the given key from the memcache server represented by this node and send the response to the given channel
 func (node *Node) Delete(key string, finishChan chan (*NodeResponse)) {
 	go func() {
 		node.Log.Debug("DELETE %s", key)
-		err := node.client.Delete(key)
+		var err error
+		if node.tombstones {
+			err = node.deleteLive(key)
+		} else {
+			err = node.client.Delete(key)
+		}
+		if finishChan != nil {
+			finishChan <- node.getNodeResponse(nil, err)
+		}
+	}()
+}
+
+// Tombstone replaces an item with the given tombstone in the memcache server represented by this node, and send the response to the given channel.
+// The tombstone is written even if the key does not exist or is already deleted, in which case ErrCacheMiss is sent.
+func (node *Node) Tombstone(tombstone *Item, finishChan chan (*NodeResponse)) {
+	go func() {
+		node.Log.Debug("TOMBSTONE %s Expire %s", tombstone.Key, *tombstone.Expiration)
+		mcItem, err := tombstone.encode(node.Encoding)
+		if err != nil {
+			node.encodeFailed(tombstone, err, finishChan)
+			return
+		}
+		err = node.swapLive(mcItem.Key, func(existing *memcache.Item) error {
+			existing.Value = mcItem.Value
+			existing.Flags = mcItem.Flags
+			existing.Expiration = mcItem.Expiration
+			return nil
+		})
+		if err == memcache.ErrCacheMiss {
+			err = node.client.Set(mcItem)
+			if err == nil {
+				err = memcache.ErrCacheMiss
+			}
+		}
 		if finishChan != nil {
 			finishChan <- node.getNodeResponse(nil, err)
 		}
@@ -100,14 +284,20 @@ func (node *Node) Delete(key string, finishChan chan (*NodeResponse)) {
 func (node *Node) Touch(key string, seconds int32, finishChan chan (*NodeResponse)) {
 	go func() {
 		node.Log.Debug("TOUCH %s", key)
-		err := node.client.Touch(key, seconds)
+		var err error
+		if node.Encoding.isRaw(key) {
+			err = node.client.Touch(key, seconds)
+		} else {
+			// The expiry in the header must be rewritten, and a tombstone is not touched, as the key was deleted
+			err = node.touchLive(key, seconds)
+		}
 		if finishChan != nil {
 			finishChan <- node.getNodeResponse(nil, err)
 		}
 	}()
 }
 
-// HealthCheck performs a healthcheck on the memcache server represented by this node, update IsHealthy, and return it
+// HealthCheck performs a healthcheck on the memcache server represented by this node, update its health, and return it
 func (node *Node) HealthCheck() (bool, error) {
 	// Read a Random key, expect ErrCacheMiss
 	x := make([]byte, 32)
@@ -120,37 +310,240 @@ func (node *Node) HealthCheck() (bool, error) {
 		return false, err
 	}
 	node.getNodeResponse(nil, err)
-	return node.IsHealthy, nil
+	return node.IsHealthy(), nil
+}
+
+// addOverTombstone replaces a tombstone with the given encoded item, returning ErrNotStored if the existing value is not a tombstone
+func (node *Node) addOverTombstone(mcItem *memcache.Item) error {
+	existing, err := node.client.Get(mcItem.Key)
+	if err == memcache.ErrCacheMiss {
+		return node.client.Add(mcItem)
+	}
+	if err != nil {
+		return err
+	}
+	haitem, err := decodeItem(existing, node.Encoding)
+	if err != nil || !haitem.tombstone {
+		return memcache.ErrNotStored
+	}
+
+	// Swap using the CAS id of the tombstone
+	existing.Value = mcItem.Value
+	existing.Flags = mcItem.Flags
+	existing.Expiration = mcItem.Expiration
+	err = node.client.CompareAndSwap(existing)
+	if err == memcache.ErrCASConflict || err == memcache.ErrCacheMiss {
+		return memcache.ErrNotStored
+	}
+	return err
+}
+
+// SWAP_LIVE_ATTEMPTS is the number of times swapLive reads and swaps an item that changes concurrently
+const SWAP_LIVE_ATTEMPTS = 3
+
+// getLive returns the existing item for the given key, returning ErrCacheMiss if it does not exist or is a tombstone
+func (node *Node) getLive(key string) (*memcache.Item, error) {
+	existing, err := node.client.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	haitem, err := decodeItem(existing, node.Encoding)
+	if err == nil && haitem.tombstone {
+		return nil, memcache.ErrCacheMiss
+	}
+	return existing, nil
+}
+
+// swapLive modifies the existing item for the given key with swap, and writes it using its CAS id. ErrCacheMiss is
+// returned if the key does not exist or is a tombstone, and errors from swap are returned.
+func (node *Node) swapLive(key string, swap func(existing *memcache.Item) error) error {
+	var err error
+	for attempt := 0; attempt < SWAP_LIVE_ATTEMPTS; attempt++ {
+		var existing *memcache.Item
+		existing, err = node.getLive(key)
+		if err != nil {
+			return err
+		}
+		if err = swap(existing); err != nil {
+			return err
+		}
+		err = node.client.CompareAndSwap(existing)
+		if err != memcache.ErrCASConflict {
+			return err
+		}
+		// The item changed since it was read, it may now be a tombstone
+	}
+	return err
+}
+
+// touchLive rewrites the existing item for the given key with the given memcached expiration, also writing the expiry
+// to its header, which is checked when the item is read. The chunks of a chunked item are touched too. ErrCacheMiss is
+// returned if the key does not exist or is a tombstone.
+func (node *Node) touchLive(key string, seconds int32) error {
+	var manifestItem *Item
+	err := node.swapLive(key, func(existing *memcache.Item) error {
+		existing.Expiration = seconds
+		haitem, err := decodeItem(existing, node.Encoding)
+		if err != nil {
+			// Values that cannot be read are touched as they are
+			node.Log.Warn("TOUCH %s: %s", key, err)
+			return nil
+		}
+		haitem.Expiration = touchExpiration(seconds)
+		mcItem, err := haitem.encode(node.Encoding)
+		if err != nil {
+			return err
+		}
+		existing.Value = mcItem.Value
+		existing.Flags = mcItem.Flags
+		manifestItem = nil
+		if haitem.chunked {
+			manifestItem = haitem
+		}
+		return nil
+	})
+	if err != nil || manifestItem == nil {
+		return err
+	}
+
+	// Chunks expire with the manifest, a missing chunk makes the value a miss when read
+	manifest, err := decodeManifest(manifestItem.Value)
+	if err != nil {
+		node.Log.Warn("TOUCH %s: %s", key, err)
+		return nil
+	}
+	for _, chunkKey := range manifest.chunkKeys(key) {
+		if chunkErr := node.touchLive(chunkKey, seconds); chunkErr != nil {
+			node.Log.Warn("TOUCH %s: %s", chunkKey, chunkErr)
+		}
+	}
+	return nil
+}
+
+// touchExpiration returns the expiry time of an item touched with the given memcached expiration, which is relative
+// seconds up to MEMCACHE_MAX_RELATIVE_EXPIRY and an absolute UNIX time beyond, or nil for no expiry
+func touchExpiration(seconds int32) *time.Time {
+	if seconds == 0 {
+		return nil
+	}
+	expiration := time.Unix(int64(seconds), 0)
+	if seconds <= MEMCACHE_MAX_RELATIVE_EXPIRY {
+		expiration = time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+	return &expiration
+}
+
+// deleteLive deletes the item for the given key, returning ErrCacheMiss if it does not exist or is a tombstone. A
+// tombstone is deleted.
+func (node *Node) deleteLive(key string) error {
+	_, liveErr := node.getLive(key)
+	if liveErr != nil && liveErr != memcache.ErrCacheMiss {
+		return liveErr
+	}
+	err := node.client.Delete(key)
+	if err == nil {
+		return liveErr
+	}
+	return err
+}
+
+// encodeFailed logs an error encoding the given item and sends it to the given channel. The node remains healthy.
+func (node *Node) encodeFailed(item *Item, err error, finishChan chan (*NodeResponse)) {
+	node.Log.Error("Encoding %s: %s", item.Key, err)
+	node.nodeFailed(err, false)
+	if finishChan != nil {
+		finishChan <- NewNodeResponse(node, nil, &NodeError{Endpoint: node.Endpoint, Err: err})
+	}
 }
 
 func (node *Node) getNodeResponse(item *memcache.Item, err error) *NodeResponse {
 	var haitem *Item
-	node.LastHealthCheck = time.Now()
-	if err != nil &&
-		err != memcache.ErrCacheMiss &&
-		err != memcache.ErrCASConflict &&
-		err != memcache.ErrNotStored &&
-		err != memcache.ErrNoStats &&
-		err != memcache.ErrMalformedKey {
+	node.lastHealthCheck.Store(time.Now().UnixNano())
+	if isTransportError(err) {
 		node.markUnhealthy(err)
+		node.nodeFailed(err, true)
 	} else {
 		node.markHealthy()
 		if item != nil {
-			haitem, err = NewItemFromMemcacheItem(item)
+			haitem, err = decodeItem(item, node.Encoding)
+			if err == ErrChecksumMismatch {
+				// Treat as a miss, so the item is synchronised from another node
+				node.checksumFailed(item.Key)
+				err = memcache.ErrCacheMiss
+			}
+			if haitem != nil && haitem.expired() {
+				// memcached may not be able to expire the item
+				haitem, err = nil, memcache.ErrCacheMiss
+			}
+			if haitem != nil {
+				haitem.casItems = map[string]*memcache.Item{node.Endpoint: item}
+			}
+		}
+		if err != nil {
+			node.nodeFailed(err, false)
 		}
 	}
 	return NewNodeResponse(node, haitem, err)
 }
 
+func (node *Node) getNodeMultiResponse(items map[string]*memcache.Item, err error) *NodeResponse {
+	response := node.getNodeResponse(nil, err)
+	if response.Error != nil {
+		return response
+	}
+	response.Items = map[string]*Item{}
+	for key, item := range items {
+		haitem, err := decodeItem(item, node.Encoding)
+		if err == ErrChecksumMismatch {
+			// Treat as a miss, so the item is synchronised from another node
+			node.checksumFailed(key)
+			continue
+		}
+		if err != nil {
+			node.Log.Warn("GETMULTI %s: %s", key, err)
+			continue
+		}
+		if haitem.expired() {
+			continue
+		}
+		response.Items[key] = haitem
+	}
+	return response
+}
+
+// ChecksumFailures returns the number of items read from this node that did not match their checksum
+func (node *Node) ChecksumFailures() uint64 {
+	return atomic.LoadUint64(&node.checksumFailures)
+}
+
+func (node *Node) checksumFailed(key string) {
+	failures := atomic.AddUint64(&node.checksumFailures, 1)
+	node.Log.Warn("Checksum mismatch for %s (%d failures)", key, failures)
+}
+
+// IsHealthy returns true if the last operation on this node succeeded, or failed with a response from the node
+func (node *Node) IsHealthy() bool {
+	return node.healthy.Load()
+}
+
+// LastHealthCheck returns the time of the last operation on this node
+func (node *Node) LastHealthCheck() time.Time {
+	nanos := node.lastHealthCheck.Load()
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
 func (node *Node) markHealthy() {
-	if !node.IsHealthy {
+	if !node.healthy.Swap(true) {
 		node.Log.Info("Healthy")
+		node.events.emit(Event{Type: EVENT_NODE_HEALTHY, Endpoint: node.Endpoint})
 	}
-	node.IsHealthy = true
 }
 func (node *Node) markUnhealthy(err error) {
-	if node.IsHealthy {
+	if node.healthy.Swap(false) {
 		node.Log.Warn("Unhealthy (%s)", err)
+		node.events.emit(Event{Type: EVENT_NODE_UNHEALTHY, Endpoint: node.Endpoint, Err: err})
 	}
-	node.IsHealthy = false
 }
@@ -1,22 +1,34 @@
 package memcacheha
 
-// NodeList represents a list of memcache servers configured/discovered by this client.
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// NodeList represents a list of memcache servers configured/discovered by this client. It is safe for concurrent use:
+// the list is an immutable map, replaced with a modified copy when nodes are added or removed.
 type NodeList struct {
-	Nodes map[string]*Node
+	nodes atomic.Pointer[map[string]*Node]
+	lock  sync.Mutex
 }
 
 // NewNodeList returns a new, empty NodeList
 func NewNodeList() *NodeList {
-	return &NodeList{
-		Nodes: map[string]*Node{},
-	}
+	nodeList := &NodeList{}
+	nodeList.nodes.Store(&map[string]*Node{})
+	return nodeList
+}
+
+// GetNodes returns a snapshot of the map of config endpoints to all Nodes, healthy or not. It must not be modified.
+func (nodeList *NodeList) GetNodes() map[string]*Node {
+	return *nodeList.nodes.Load()
 }
 
 // GetHealthyNodes returns a map of config endpoints to Nodes where the node IsHealthy is true
 func (nodeList *NodeList) GetHealthyNodes() map[string]*Node {
 	out := map[string]*Node{}
-	for _, node := range nodeList.Nodes {
-		if node.IsHealthy {
+	for _, node := range nodeList.GetNodes() {
+		if node.IsHealthy() {
 			out[node.Endpoint] = node
 		}
 	}
@@ -26,8 +38,8 @@ func (nodeList *NodeList) GetHealthyNodes() map[string]*Node {
 // GetHealthyNodeCount returns the count of Nodes where the node IsHealthy is true
 func (nodeList *NodeList) GetHealthyNodeCount() int {
 	healthy := 0
-	for _, node := range nodeList.Nodes {
-		if node.IsHealthy {
+	for _, node := range nodeList.GetNodes() {
+		if node.IsHealthy() {
 			healthy++
 		}
 	}
@@ -36,11 +48,38 @@ func (nodeList *NodeList) GetHealthyNodeCount() int {
 
 // Exists returns true if a node for the given endpoint exists
 func (nodeList *NodeList) Exists(nodeAddr string) bool {
-	_, found := nodeList.Nodes[nodeAddr]
+	_, found := nodeList.GetNodes()[nodeAddr]
 	return found
 }
 
 // Add the given node to this list
 func (nodeList *NodeList) Add(node *Node) {
-	nodeList.Nodes[node.Endpoint] = node
+	nodeList.modify(func(nodes map[string]*Node) {
+		nodes[node.Endpoint] = node
+	})
+}
+
+// Remove the node for the given endpoint from this list
+func (nodeList *NodeList) Remove(nodeAddr string) {
+	nodeList.modify(func(nodes map[string]*Node) {
+		delete(nodes, nodeAddr)
+	})
+}
+
+// GetNodeCount returns the count of all Nodes, healthy or not
+func (nodeList *NodeList) GetNodeCount() int {
+	return len(nodeList.GetNodes())
+}
+
+// modify replaces the list with a copy modified by the given function
+func (nodeList *NodeList) modify(fn func(nodes map[string]*Node)) {
+	nodeList.lock.Lock()
+	defer nodeList.lock.Unlock()
+
+	nodes := map[string]*Node{}
+	for endpoint, node := range nodeList.GetNodes() {
+		nodes[endpoint] = node
+	}
+	fn(nodes)
+	nodeList.nodes.Store(&nodes)
 }
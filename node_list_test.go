@@ -0,0 +1,110 @@
+package memcacheha
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNodeList(t *testing.T) {
+	nodeList := NewNodeList()
+	a, b := NewNode(testLogger{}, "127.0.0.1:1", time.Millisecond), NewNode(testLogger{}, "127.0.0.1:2", time.Millisecond)
+	nodeList.Add(a)
+	nodeList.Add(b)
+	snapshot := nodeList.GetNodes()
+
+	a.markHealthy()
+	if count := nodeList.GetHealthyNodeCount(); count != 1 {
+		t.Errorf("expected 1 healthy node, got %d", count)
+	}
+	if _, found := nodeList.GetHealthyNodes()[a.Endpoint]; !found {
+		t.Errorf("expected %s to be healthy", a.Endpoint)
+	}
+
+	nodeList.Remove(a.Endpoint)
+	if nodeList.Exists(a.Endpoint) || nodeList.GetNodeCount() != 1 {
+		t.Errorf("expected %s to be removed", a.Endpoint)
+	}
+	if len(snapshot) != 2 {
+		t.Errorf("expected snapshot to be unchanged, got %d nodes", len(snapshot))
+	}
+}
+
+// TestNodeListConcurrency reads and writes through a Client while nodes are added, removed, and change health. Run with
+// -race to detect unsynchronised access.
+func TestNodeListConcurrency(t *testing.T) {
+	client := New(WithLogger(testLogger{}))
+	client.Timeout = time.Millisecond
+	for i := 1; i <= 3; i++ {
+		node := NewNode(testLogger{}, fmt.Sprintf("127.0.0.1:%d", i), client.Timeout)
+		node.markHealthy()
+		client.Nodes.Add(node)
+	}
+
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+
+	// Discovery churn
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			endpoint := fmt.Sprintf("127.0.0.1:%d", 4+i%3)
+			if client.Nodes.Exists(endpoint) {
+				client.Nodes.Remove(endpoint)
+			} else {
+				node := NewNode(testLogger{}, endpoint, client.Timeout)
+				node.markHealthy()
+				client.Nodes.Add(node)
+			}
+		}
+	}()
+
+	// Health changes
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, node := range client.Nodes.GetNodes() {
+				node.markHealthy()
+			}
+		}
+	}()
+
+	// Load, failing against closed ports
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				err := client.Set(&Item{Key: "foo", Value: []byte("bar")})
+				if errors.Is(err, ErrUnknown) {
+					t.Error(err)
+				}
+				client.Get("foo")
+				client.Nodes.GetHealthyNodeCount()
+			}
+		}()
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	close(done)
+	wg.Wait()
+}
@@ -4,6 +4,7 @@ package memcacheha
 type NodeResponse struct {
 	Node  *Node
 	Item  *Item
+	Items map[string]*Item
 	Error error
 }
 
@@ -0,0 +1,412 @@
+package memcacheha
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// testServer is a minimal in-memory memcached for tests, speaking the text protocol used by gomemcache. Expiry is
+// recorded but not enforced.
+type testServer struct {
+	listener net.Listener
+
+	lock  sync.Mutex
+	items map[string]*testServerItem
+	casID uint64
+
+	// reject, if not empty, is replied to every storage command instead of storing, e.g. "SERVER_ERROR out of memory"
+	reject string
+
+	// counts is the number of each command received
+	counts map[string]int
+
+	// delay is the time each command waits before it is handled
+	delay time.Duration
+}
+
+type testServerItem struct {
+	value   []byte
+	flags   uint32
+	exptime int64
+	cas     uint64
+}
+
+// newTestServer starts a testServer, closed when the test ends
+func newTestServer(t *testing.T) *testServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testServer{
+		listener: listener,
+		items:    map[string]*testServerItem{},
+		counts:   map[string]int{},
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+// newTestCluster returns a Client with count healthy testServer nodes
+func newTestCluster(t *testing.T, count int, opts ...Option) (*Client, []*testServer) {
+	servers := make([]*testServer, count)
+	endpoints := make([]string, count)
+	for i := range servers {
+		servers[i] = newTestServer(t)
+		endpoints[i] = servers[i].endpoint()
+	}
+	opts = append([]Option{WithLogger(testLogger{}), WithSources(NewStaticNodeSource(endpoints...))}, opts...)
+	client := New(opts...)
+	client.GetNodes()
+	if client.Nodes.GetHealthyNodeCount() != count {
+		t.Fatalf("expected %d healthy nodes, got %d", count, client.Nodes.GetHealthyNodeCount())
+	}
+	return client, servers
+}
+
+func (server *testServer) endpoint() string {
+	return server.listener.Addr().String()
+}
+
+// value returns the raw value stored for the given key, and whether it exists
+func (server *testServer) value(key string) ([]byte, bool) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	item, found := server.items[key]
+	if !found {
+		return nil, false
+	}
+	return item.value, true
+}
+
+// remove removes the given key, as if evicted
+func (server *testServer) remove(key string) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	delete(server.items, key)
+}
+
+// keys returns the number of keys stored
+func (server *testServer) keys() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return len(server.items)
+}
+
+// storedKeys returns the keys stored
+func (server *testServer) storedKeys() []string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	keys := make([]string, 0, len(server.items))
+	for key := range server.items {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// expiry returns the memcached expiration of the given key, or 0 if it does not exist
+func (server *testServer) expiry(key string) int64 {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	item, found := server.items[key]
+	if !found {
+		return 0
+	}
+	return item.exptime
+}
+
+// commands returns the number of the given command received
+func (server *testServer) commands(command string) int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.counts[command]
+}
+
+// setReject sets the reply to storage commands, or "" to store them
+func (server *testServer) setReject(reply string) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.reject = reply
+}
+
+// setDelay sets the time each command waits before it is handled
+func (server *testServer) setDelay(delay time.Duration) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.delay = delay
+}
+
+func (server *testServer) serve(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			return
+		}
+		var data []byte
+		switch args[0] {
+		case "set", "add", "replace", "append", "prepend", "cas":
+			if len(args) < 5 {
+				return
+			}
+			size, err := strconv.Atoi(args[4])
+			if err != nil {
+				return
+			}
+			data = make([]byte, size+2)
+			if _, err := io.ReadFull(rw, data); err != nil {
+				return
+			}
+			data = data[:size]
+		}
+		server.lock.Lock()
+		delay := server.delay
+		server.lock.Unlock()
+		time.Sleep(delay)
+		server.lock.Lock()
+		server.handle(rw, args, data)
+		server.lock.Unlock()
+		if rw.Flush() != nil {
+			return
+		}
+	}
+}
+
+// handle replies to the command with the given arguments and data, with the lock held
+func (server *testServer) handle(w io.Writer, args []string, data []byte) {
+	server.counts[args[0]]++
+	switch args[0] {
+	case "get", "gets":
+		for _, key := range args[1:] {
+			if item, found := server.items[key]; found {
+				fmt.Fprintf(w, "VALUE %s %d %d %d\r\n%s\r\n", key, item.flags, len(item.value), item.cas, item.value)
+			}
+		}
+		fmt.Fprint(w, "END\r\n")
+
+	case "set", "add", "replace", "append", "prepend", "cas":
+		if server.reject != "" {
+			fmt.Fprintf(w, "%s\r\n", server.reject)
+			return
+		}
+		key := args[1]
+		flags, _ := strconv.ParseUint(args[2], 10, 32)
+		exptime, _ := strconv.ParseInt(args[3], 10, 64)
+		existing, found := server.items[key]
+		switch args[0] {
+		case "add":
+			if found {
+				fmt.Fprint(w, "NOT_STORED\r\n")
+				return
+			}
+		case "replace", "append", "prepend":
+			if !found {
+				fmt.Fprint(w, "NOT_STORED\r\n")
+				return
+			}
+		case "cas":
+			if !found {
+				fmt.Fprint(w, "NOT_FOUND\r\n")
+				return
+			}
+			cas, _ := strconv.ParseUint(args[5], 10, 64)
+			if cas != existing.cas {
+				fmt.Fprint(w, "EXISTS\r\n")
+				return
+			}
+		}
+		switch args[0] {
+		case "append":
+			data = append(append([]byte{}, existing.value...), data...)
+		case "prepend":
+			data = append(append([]byte{}, data...), existing.value...)
+		}
+		server.casID++
+		server.items[key] = &testServerItem{value: data, flags: uint32(flags), exptime: exptime, cas: server.casID}
+		fmt.Fprint(w, "STORED\r\n")
+
+	case "delete":
+		if _, found := server.items[args[1]]; !found {
+			fmt.Fprint(w, "NOT_FOUND\r\n")
+			return
+		}
+		delete(server.items, args[1])
+		fmt.Fprint(w, "DELETED\r\n")
+
+	case "touch":
+		item, found := server.items[args[1]]
+		if !found {
+			fmt.Fprint(w, "NOT_FOUND\r\n")
+			return
+		}
+		item.exptime, _ = strconv.ParseInt(args[2], 10, 64)
+		fmt.Fprint(w, "TOUCHED\r\n")
+
+	default:
+		fmt.Fprint(w, "ERROR\r\n")
+	}
+}
+
+func TestNodeTombstone(t *testing.T) {
+	client, servers := newTestCluster(t, 2, WithTombstoneTTL(time.Minute))
+	if err := client.Set(&Item{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Delete("foo"); err != nil {
+		t.Fatalf("expected delete to succeed, got %v", err)
+	}
+
+	// The tombstone is not a value for Delete, Replace or Touch
+	if err := client.Delete("foo"); err != memcache.ErrCacheMiss {
+		t.Errorf("expected ErrCacheMiss deleting a deleted key, got %v", err)
+	}
+	if err := client.Replace(&Item{Key: "foo", Value: []byte("baz")}); err != memcache.ErrNotStored {
+		t.Errorf("expected ErrNotStored replacing a deleted key, got %v", err)
+	}
+	if err := client.Touch("foo", 60); err != memcache.ErrCacheMiss {
+		t.Errorf("expected ErrCacheMiss touching a deleted key, got %v", err)
+	}
+	if _, err := client.Get("foo"); err != memcache.ErrCacheMiss {
+		t.Errorf("expected deleted key to stay deleted, got %v", err)
+	}
+	for _, server := range servers {
+		value, found := server.value("foo")
+		if !found {
+			t.Fatalf("expected tombstone on %s", server.endpoint())
+		}
+		item, err := decodeItem(&memcache.Item{Key: "foo", Value: value}, &client.Encoding)
+		if err != nil || !item.tombstone {
+			t.Errorf("expected tombstone on %s, got %+v (%v)", server.endpoint(), item, err)
+		}
+	}
+
+	// Add writes over the tombstone, after which the key is live again
+	if err := client.Add(&Item{Key: "foo", Value: []byte("baz")}); err != nil {
+		t.Fatalf("expected add over tombstone to succeed, got %v", err)
+	}
+	if err := client.Touch("foo", 60); err != nil {
+		t.Errorf("expected touch to succeed, got %v", err)
+	}
+	if err := client.Replace(&Item{Key: "foo", Value: []byte("qux")}); err != nil {
+		t.Errorf("expected replace to succeed, got %v", err)
+	}
+}
+
+func TestNodeWithoutTombstones(t *testing.T) {
+	client, servers := newTestCluster(t, 1)
+	if err := client.Set(&Item{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+	gets := servers[0].commands("gets")
+
+	// Without tombstones, nodes use the native commands rather than reading items first. Touch reads the item to
+	// rewrite the expiry in its header.
+	if err := client.Replace(&Item{Key: "foo", Value: []byte("baz")}); err != nil {
+		t.Errorf("expected replace to succeed, got %v", err)
+	}
+	if err := client.Delete("foo"); err != nil {
+		t.Errorf("expected delete to succeed, got %v", err)
+	}
+	if _, found := servers[0].value("foo"); found {
+		t.Error("expected key to be deleted")
+	}
+	if err := client.Delete("foo"); err != memcache.ErrCacheMiss {
+		t.Errorf("expected ErrCacheMiss deleting a deleted key, got %v", err)
+	}
+	if err := client.Replace(&Item{Key: "foo", Value: []byte("qux")}); err != memcache.ErrNotStored {
+		t.Errorf("expected ErrNotStored replacing a deleted key, got %v", err)
+	}
+	if reads := servers[0].commands("gets") - gets; reads != 0 {
+		t.Errorf("expected no reads, got %d", reads)
+	}
+}
+
+func TestNodeTouchExtendsExpiry(t *testing.T) {
+	for _, tombstoneTTL := range []time.Duration{0, time.Minute} {
+		client, servers := newTestCluster(t, 2, WithTombstoneTTL(tombstoneTTL))
+		expiration := time.Now().Add(1500 * time.Millisecond)
+		if err := client.Set(&Item{Key: "foo", Value: []byte("bar"), Expiration: &expiration}); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Touch("foo", 3600); err != nil {
+			t.Fatalf("expected touch to succeed, got %v", err)
+		}
+
+		// The expiry in the header is checked on read, so must be extended with memcached's
+		time.Sleep(2 * time.Second)
+		item, err := client.Get("foo")
+		if err != nil {
+			t.Fatalf("expected a hit after the original expiry with tombstone TTL %s, got %v", tombstoneTTL, err)
+		}
+		if string(item.Value) != "bar" || item.Expiration == nil || time.Until(*item.Expiration) < 59*time.Minute {
+			t.Errorf("expected bar expiring in an hour, got %q expiring %v", item.Value, item.Expiration)
+		}
+		for _, server := range servers {
+			if expiry := server.expiry("foo"); expiry != 3600 {
+				t.Errorf("expected memcached expiration 3600 on %s, got %d", server.endpoint(), expiry)
+			}
+		}
+
+		if err := client.Touch("missing", 3600); err != memcache.ErrCacheMiss {
+			t.Errorf("expected ErrCacheMiss touching a missing key, got %v", err)
+		}
+	}
+}
+
+func TestNodeTouchChunks(t *testing.T) {
+	client, servers := newTestCluster(t, 1, WithChunkSize(testChunkSize))
+	value := make([]byte, 3*testChunkSize)
+	if _, err := rand.Read(value); err != nil {
+		t.Fatal(err)
+	}
+	expiration := time.Now().Add(time.Minute)
+	if err := client.Set(&Item{Key: "foo", Value: value, Expiration: &expiration}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Touch("foo", 3600); err != nil {
+		t.Fatalf("expected touch to succeed, got %v", err)
+	}
+
+	// The chunks expire with the manifest
+	for _, key := range servers[0].storedKeys() {
+		if expiry := servers[0].expiry(key); expiry != 3600 {
+			t.Errorf("expected memcached expiration 3600 for %s, got %d", key, expiry)
+		}
+		mcItem, _ := servers[0].value(key)
+		item, err := decodeItem(&memcache.Item{Key: key, Value: mcItem}, &client.Encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.Expiration == nil || time.Until(*item.Expiration) < 59*time.Minute {
+			t.Errorf("expected %s to expire in an hour, got %v", key, item.Expiration)
+		}
+	}
+	item, err := client.Get("foo")
+	if err != nil || !bytes.Equal(item.Value, value) {
+		t.Errorf("expected value to be read after touch, got %v", err)
+	}
+}
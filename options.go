@@ -0,0 +1,92 @@
+package memcacheha
+
+import (
+	"time"
+)
+
+// Option configures a Client created with New
+type Option func(client *Client)
+
+// WithLogger sets the Logger of the Client. Without it, logs are discarded.
+func WithLogger(logger Logger) Option {
+	return func(client *Client) {
+		client.Log = logger
+	}
+}
+
+// WithSources adds the given NodeSources to the Client
+func WithSources(sources ...NodeSource) Option {
+	return func(client *Client) {
+		client.Sources = append(client.Sources, sources...)
+	}
+}
+
+// WithTimeout sets the timeout of each operation on a node (DEFAULT_TIMEOUT)
+func WithTimeout(timeout time.Duration) Option {
+	return func(client *Client) {
+		client.Timeout = timeout
+	}
+}
+
+// WithGetNodesPeriod sets the period between checking all sources for new or deprecated nodes (DEFAULT_GET_NODES_PERIOD)
+func WithGetNodesPeriod(period time.Duration) Option {
+	return func(client *Client) {
+		client.GetNodesPeriod = period
+	}
+}
+
+// WithHealthCheckPeriod sets the period between healthchecks on nodes (DEFAULT_HEALTHCHECK_PERIOD)
+func WithHealthCheckPeriod(period time.Duration) Option {
+	return func(client *Client) {
+		client.HealthCheckPeriod = period
+	}
+}
+
+// WithCASRetries sets the number of attempts made by read-modify-write operations such as Increment (DEFAULT_CAS_RETRIES)
+func WithCASRetries(retries int) Option {
+	return func(client *Client) {
+		client.CASRetries = retries
+	}
+}
+
+// WithDefaultReadConsistency sets the number of nodes read from, unless overridden with WithReadConsistency
+func WithDefaultReadConsistency(consistency Consistency) Option {
+	return func(client *Client) {
+		client.ReadConsistency = consistency
+	}
+}
+
+// WithDefaultWriteConsistency sets the number of nodes that must acknowledge writes, unless overridden with WithWriteConsistency
+func WithDefaultWriteConsistency(consistency Consistency) Option {
+	return func(client *Client) {
+		client.WriteConsistency = consistency
+	}
+}
+
+// WithTombstoneTTL sets the time tombstones are kept for deleted keys, see Client.TombstoneTTL
+func WithTombstoneTTL(ttl time.Duration) Option {
+	return func(client *Client) {
+		client.TombstoneTTL = ttl
+	}
+}
+
+// WithChunkSize sets the largest value written as a single item, see Client.ChunkSize (DEFAULT_CHUNK_SIZE)
+func WithChunkSize(size int) Option {
+	return func(client *Client) {
+		client.ChunkSize = size
+	}
+}
+
+// WithEncoding sets how items are encoded as memcache values, see Encoding
+func WithEncoding(encoding Encoding) Option {
+	return func(client *Client) {
+		client.Encoding = encoding
+	}
+}
+
+// WithKeyTransformer sets the transformer applied to keys before they are sent to nodes, e.g. HashLongKeys
+func WithKeyTransformer(keyTransformer KeyTransformer) Option {
+	return func(client *Client) {
+		client.KeyTransformer = keyTransformer
+	}
+}
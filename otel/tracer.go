@@ -0,0 +1,75 @@
+// Package otel provides a memcacheha.Tracer that starts OpenTelemetry spans, e.g.
+//
+//	client := memcacheha.New(memcacheha.WithTracer(otel.NewTracer(provider)))
+package otel
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/stqry/memcacheha"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// INSTRUMENTATION_NAME is the name of the tracer used for memcacheha spans
+const INSTRUMENTATION_NAME = "github.com/stqry/memcacheha"
+
+var _ memcacheha.Tracer = (*Tracer)(nil)
+
+// Tracer starts OpenTelemetry client spans for memcacheha
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// NewTracer returns a new Tracer using a tracer from the given TracerProvider
+func NewTracer(provider trace.TracerProvider) *Tracer {
+	return &Tracer{
+		tracer: provider.Tracer(INSTRUMENTATION_NAME),
+	}
+}
+
+// Start implements memcacheha.Tracer
+func (tracer *Tracer) Start(ctx context.Context, name string) (context.Context, memcacheha.Span) {
+	ctx, otelSpan := tracer.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+	return ctx, &span{span: otelSpan}
+}
+
+// StartLinked implements memcacheha.Tracer
+func (tracer *Tracer) StartLinked(ctx context.Context, name string) memcacheha.Span {
+	_, otelSpan := tracer.tracer.Start(ctx, name,
+		trace.WithNewRoot(),
+		trace.WithLinks(trace.LinkFromContext(ctx)),
+		trace.WithSpanKind(trace.SpanKindClient),
+	)
+	return &span{span: otelSpan}
+}
+
+// span is a memcacheha.Span wrapping an OpenTelemetry span
+type span struct {
+	span trace.Span
+}
+
+// SetAttribute implements memcacheha.Span
+func (span *span) SetAttribute(key string, value interface{}) {
+	switch value := value.(type) {
+	case string:
+		span.span.SetAttributes(attribute.String(key, value))
+	case int:
+		span.span.SetAttributes(attribute.Int(key, value))
+	case bool:
+		span.span.SetAttributes(attribute.Bool(key, value))
+	default:
+		span.span.SetAttributes(attribute.String(key, fmt.Sprint(value)))
+	}
+}
+
+// End implements memcacheha.Span
+func (span *span) End(err error) {
+	if err != nil {
+		span.span.RecordError(err)
+		span.span.SetStatus(codes.Error, err.Error())
+	}
+	span.span.End()
+}
@@ -0,0 +1,157 @@
+// Package prometheus provides a memcacheha.Metrics that is also a Prometheus collector, e.g.
+//
+//	metrics := prometheus.NewMetrics("myapp")
+//	registry.MustRegister(metrics)
+//	client := memcacheha.New(memcacheha.WithMetrics(metrics))
+package prometheus
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/stqry/memcacheha"
+)
+
+var _ memcacheha.Metrics = (*Metrics)(nil)
+
+// Metrics records the metrics of a memcacheha Client in Prometheus metrics, named with the given namespace and the
+// subsystem "memcacheha"
+type Metrics struct {
+	operations      *prom.HistogramVec
+	lookups         *prom.CounterVec
+	nodeErrors      *prom.CounterVec
+	repairs         *prom.CounterVec
+	healthyNodes    prom.GaugeFunc
+	discoveryErrors prom.Counter
+
+	lock  sync.Mutex
+	nodes *memcacheha.NodeList
+}
+
+// NewMetrics returns a new Metrics with the given namespace, which must be registered with a Prometheus registry
+func NewMetrics(namespace string) *Metrics {
+	metrics := &Metrics{
+		operations: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "memcacheha",
+			Name:      "operation_duration_seconds",
+			Help:      "Duration of memcacheha operations, by operation and result (ok, miss, not_stored, error).",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"op", "result"}),
+		lookups: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "memcacheha",
+			Name:      "lookups_total",
+			Help:      "Keys read, by operation and result (hit or miss).",
+		}, []string{"op", "result"}),
+		nodeErrors: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "memcacheha",
+			Name:      "node_errors_total",
+			Help:      "Errors returned by nodes, by endpoint and type (transport or response).",
+		}, []string{"endpoint", "type"}),
+		repairs: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "memcacheha",
+			Name:      "repaired_nodes_total",
+			Help:      "Nodes synchronised with the newest item, by operation.",
+		}, []string{"op"}),
+		discoveryErrors: prom.NewCounter(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "memcacheha",
+			Name:      "discovery_errors_total",
+			Help:      "Errors returned by node sources.",
+		}),
+	}
+	metrics.healthyNodes = prom.NewGaugeFunc(prom.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "memcacheha",
+		Name:      "healthy_nodes",
+		Help:      "Number of healthy nodes.",
+	}, metrics.healthyNodeCount)
+	return metrics
+}
+
+// Describe implements prometheus.Collector
+func (metrics *Metrics) Describe(ch chan<- *prom.Desc) {
+	metrics.operations.Describe(ch)
+	metrics.lookups.Describe(ch)
+	metrics.nodeErrors.Describe(ch)
+	metrics.repairs.Describe(ch)
+	metrics.healthyNodes.Describe(ch)
+	metrics.discoveryErrors.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (metrics *Metrics) Collect(ch chan<- prom.Metric) {
+	metrics.operations.Collect(ch)
+	metrics.lookups.Collect(ch)
+	metrics.nodeErrors.Collect(ch)
+	metrics.repairs.Collect(ch)
+	metrics.healthyNodes.Collect(ch)
+	metrics.discoveryErrors.Collect(ch)
+}
+
+// ObserveOperation implements memcacheha.Metrics
+func (metrics *Metrics) ObserveOperation(op string, duration time.Duration, err error) {
+	metrics.operations.WithLabelValues(op, result(err)).Observe(duration.Seconds())
+}
+
+// AddLookups implements memcacheha.Metrics
+func (metrics *Metrics) AddLookups(op string, hits int, misses int) {
+	metrics.lookups.WithLabelValues(op, "hit").Add(float64(hits))
+	metrics.lookups.WithLabelValues(op, "miss").Add(float64(misses))
+}
+
+// IncNodeError implements memcacheha.Metrics
+func (metrics *Metrics) IncNodeError(endpoint string, err error, transport bool) {
+	errorType := "response"
+	if transport {
+		errorType = "transport"
+	}
+	metrics.nodeErrors.WithLabelValues(endpoint, errorType).Inc()
+}
+
+// AddRepairs implements memcacheha.Metrics
+func (metrics *Metrics) AddRepairs(op string, nodes int) {
+	metrics.repairs.WithLabelValues(op).Add(float64(nodes))
+}
+
+// WatchNodes implements memcacheha.Metrics
+func (metrics *Metrics) WatchNodes(nodes *memcacheha.NodeList) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	metrics.nodes = nodes
+}
+
+// healthyNodeCount returns the number of healthy nodes in the watched NodeList when the gauge is collected
+func (metrics *Metrics) healthyNodeCount() float64 {
+	metrics.lock.Lock()
+	nodes := metrics.nodes
+	metrics.lock.Unlock()
+	if nodes == nil {
+		return 0
+	}
+	return float64(nodes.GetHealthyNodeCount())
+}
+
+// IncDiscoveryError implements memcacheha.Metrics
+func (metrics *Metrics) IncDiscoveryError() {
+	metrics.discoveryErrors.Inc()
+}
+
+// result returns the result label for an operation that returned the given error
+func result(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, memcache.ErrCacheMiss):
+		return "miss"
+	case errors.Is(err, memcache.ErrNotStored):
+		return "not_stored"
+	}
+	return "error"
+}
@@ -0,0 +1,115 @@
+package memcacheha
+
+import (
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// reconciliation collects the responses from nodes for a single key, to find the newest item and the nodes to synchronise
+type reconciliation struct {
+	key    string
+	hits   []*NodeResponse
+	misses []*Node
+}
+
+// newReconciliation returns a new, empty reconciliation for the given key
+func newReconciliation(key string) *reconciliation {
+	return &reconciliation{
+		key: key,
+	}
+}
+
+// add records the given response, ignoring errors other than ErrCacheMiss
+func (r *reconciliation) add(response *NodeResponse) {
+	if response.Error == memcache.ErrCacheMiss {
+		r.misses = append(r.misses, response.Node)
+	}
+	if response.Error == nil && response.Item != nil {
+		r.hits = append(r.hits, response)
+	}
+}
+
+// newest returns the newest item returned by any node, which may be a tombstone, or nil if no node returned an item
+func (r *reconciliation) newest() *Item {
+	var newest *Item
+	for _, hit := range r.hits {
+		if newest == nil || !newest.newerThan(hit.Item) {
+			newest = hit.Item
+		}
+	}
+	return newest
+}
+
+// agreed returns the number of nodes agreeing with the given newest item, where misses agree with a tombstone
+func (r *reconciliation) agreed(newest *Item) int {
+	if newest == nil {
+		return len(r.misses)
+	}
+	agreed := 0
+	if newest.tombstone {
+		agreed = len(r.misses)
+	}
+	for _, hit := range r.hits {
+		if newest.equal(hit.Item) || (newest.tombstone && hit.Item.tombstone) {
+			agreed++
+		}
+	}
+	return agreed
+}
+
+// repair synchronises nodes with the given newest item. Nodes that missed, hold an older item, or hold an item without a
+// header are written the newest item, or if the newest item is a tombstone, the item is deleted from nodes that hold it.
+// If trace is not nil, it returns the channel for the given number of nodes synchronised to respond on.
+func (r *reconciliation) repair(log Logger, events *eventBus, op string, newest *Item, trace func(nodeCount int) chan (*NodeResponse)) {
+	if newest == nil {
+		return
+	}
+
+	var nodesToSync []*Node
+
+	// A tombstone is authoritative, delete the item from nodes that still hold it
+	if newest.tombstone {
+		for _, hit := range r.hits {
+			if !hit.Item.tombstone {
+				nodesToSync = append(nodesToSync, hit.Node)
+			}
+		}
+		if len(nodesToSync) > 0 {
+			log.Info("%s: Deleting %s from %d nodes", op, r.key, len(nodesToSync))
+			repairChan := r.repairChan(trace, len(nodesToSync))
+			for _, node := range nodesToSync {
+				node.Delete(r.key, repairChan)
+			}
+			events.emit(Event{Type: EVENT_REPAIR_PERFORMED, Op: op, Key: r.key, Nodes: len(nodesToSync)})
+		}
+		return
+	}
+
+	nodesToSync = append(nodesToSync, r.misses...)
+	for _, hit := range r.hits {
+		if !newest.equal(hit.Item) || hit.Item.raw {
+			nodesToSync = append(nodesToSync, hit.Node)
+		}
+	}
+	if len(nodesToSync) == 0 {
+		return
+	}
+
+	if newest.Expiration != nil {
+		log.Info("%s: Synchronising %d nodes for %s with %s expiry", op, len(nodesToSync), r.key, *newest.Expiration)
+	} else {
+		log.Info("%s: Synchronising %d nodes for %s", op, len(nodesToSync), r.key)
+	}
+	repairChan := r.repairChan(trace, len(nodesToSync))
+	for _, node := range nodesToSync {
+		node.Set(newest, repairChan)
+	}
+	events.emit(Event{Type: EVENT_REPAIR_PERFORMED, Op: op, Key: r.key, Nodes: len(nodesToSync)})
+}
+
+// repairChan returns the channel for the given number of nodes synchronised to respond on, or nil if trace is nil
+func (r *reconciliation) repairChan(trace func(nodeCount int) chan (*NodeResponse), nodeCount int) chan (*NodeResponse) {
+	if trace == nil {
+		return nil
+	}
+	return trace(nodeCount)
+}
@@ -0,0 +1,47 @@
+package memcacheha
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func TestReconciliationNewest(t *testing.T) {
+	now := time.Now()
+	older := (&Item{Key: "foo", Value: []byte("older")}).withTimestamp(now.Add(-time.Second))
+	newer := (&Item{Key: "foo", Value: []byte("newer")}).withTimestamp(now)
+
+	result := newReconciliation("foo")
+	result.add(NewNodeResponse(nil, newer, nil))
+	result.add(NewNodeResponse(nil, older, nil))
+	result.add(NewNodeResponse(nil, nil, memcache.ErrCacheMiss))
+	result.add(NewNodeResponse(nil, nil, ErrUnknown))
+
+	newest := result.newest()
+	if newest != newer {
+		t.Fatalf("expected %+v, got %+v", newer, newest)
+	}
+	if agreed := result.agreed(newest); agreed != 1 {
+		t.Errorf("expected 1 node to agree, got %d", agreed)
+	}
+}
+
+func TestReconciliationTombstone(t *testing.T) {
+	now := time.Now()
+	item := (&Item{Key: "foo", Value: []byte("bar")}).withTimestamp(now.Add(-time.Second))
+	tombstone := newTombstone("foo", now.Add(time.Minute))
+
+	result := newReconciliation("foo")
+	result.add(NewNodeResponse(nil, item, nil))
+	result.add(NewNodeResponse(nil, tombstone, nil))
+	result.add(NewNodeResponse(nil, nil, memcache.ErrCacheMiss))
+
+	newest := result.newest()
+	if newest != tombstone {
+		t.Fatalf("expected tombstone, got %+v", newest)
+	}
+	if agreed := result.agreed(newest); agreed != 2 {
+		t.Errorf("expected 2 nodes to agree, got %d", agreed)
+	}
+}
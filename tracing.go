@@ -0,0 +1,173 @@
+package memcacheha
+
+import (
+	"context"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Tracer starts spans for Client operations, the call to each node, and repairs, set with WithTracer. See the otel
+// sub-package for an OpenTelemetry Tracer.
+type Tracer interface {
+	// Start starts a span with the given name, as a child of the span in ctx if any, returning a context holding it
+	Start(ctx context.Context, name string) (context.Context, Span)
+
+	// StartLinked starts a span with the given name in a new trace, linked to the span in ctx, for work that continues
+	// after the operation that caused it has returned
+	StartLinked(ctx context.Context, name string) Span
+}
+
+// Span is a span started by a Tracer
+type Span interface {
+	// SetAttribute sets an attribute of the span, the value is a string, int or bool
+	SetAttribute(key string, value interface{})
+
+	// End ends the span, with the error that failed it, or nil
+	End(err error)
+}
+
+// WithTracer sets the Tracer of the Client. Without it, no spans are started.
+func WithTracer(tracer Tracer) Option {
+	return func(client *Client) {
+		client.Tracer = tracer
+	}
+}
+
+// operation is a Client operation in progress, recorded in Metrics and a span when it ends
+type operation struct {
+	client *Client
+	name   string
+	start  time.Time
+	span   Span
+}
+
+// startOperation starts the operation with the given name on the given key, or "" for many keys, returning a context
+// holding its span
+func (client *Client) startOperation(ctx context.Context, name string, key string) (context.Context, *operation) {
+	op := &operation{
+		client: client,
+		name:   name,
+		start:  time.Now(),
+	}
+	if client.Tracer != nil {
+		ctx, op.span = client.Tracer.Start(ctx, "memcacheha."+name)
+		if key != "" {
+			op.setAttribute("memcacheha.key", key)
+		}
+	}
+	return ctx, op
+}
+
+// setAttribute sets an attribute of the span of the operation, if it is traced
+func (op *operation) setAttribute(key string, value interface{}) {
+	if op.span != nil {
+		op.span.SetAttribute(key, value)
+	}
+}
+
+// end records the duration of the operation, and the error it returned
+func (op *operation) end(err *error) {
+	op.client.Metrics.ObserveOperation(op.name, time.Since(op.start), *err)
+	if op.span != nil {
+		endSpan(op.span, *err)
+	}
+}
+
+// traceNodes starts a span for the call of the operation with the given name to each of the given nodes, returning the
+// channel for the nodes to respond on. Each span ends when its node responds, and the response is sent to statusChan.
+// The item is the item written, or nil for reads. Without a Tracer, statusChan is returned.
+func (client *Client) traceNodes(ctx context.Context, name string, item *Item, nodes map[string]*Node, statusChan chan (*NodeResponse)) chan (*NodeResponse) {
+	if client.Tracer == nil {
+		return statusChan
+	}
+
+	spans := map[*Node]Span{}
+	for _, node := range nodes {
+		_, span := client.Tracer.Start(ctx, "memcacheha.Node."+name)
+		span.SetAttribute("memcacheha.endpoint", node.Endpoint)
+		if item != nil {
+			span.SetAttribute("memcacheha.bytes", len(item.Value))
+		}
+		spans[node] = span
+	}
+
+	nodeChan := make(chan (*NodeResponse), len(nodes))
+	go func() {
+		for i := 0; i < len(nodes); i++ {
+			response := <-nodeChan
+			span := spans[response.Node]
+			if item == nil {
+				span.SetAttribute("memcacheha.bytes", responseBytes(response))
+			}
+			endSpan(span, response.Error)
+			statusChan <- response
+		}
+	}()
+	return nodeChan
+}
+
+// traceRepair starts a span for the repair of the given key by the operation with the given name, linked to the span
+// in ctx, returning the channel for the given number of nodes to respond on. The span ends when all have responded.
+// Without a Tracer, nil is returned.
+func (client *Client) traceRepair(ctx context.Context, name string, key string, nodeCount int) chan (*NodeResponse) {
+	if client.Tracer == nil {
+		return nil
+	}
+
+	span := client.Tracer.StartLinked(ctx, "memcacheha.Repair")
+	span.SetAttribute("memcacheha.op", name)
+	span.SetAttribute("memcacheha.key", key)
+	span.SetAttribute("memcacheha.nodes", nodeCount)
+
+	repairChan := make(chan (*NodeResponse), nodeCount)
+	go func() {
+		var err error
+		for i := 0; i < nodeCount; i++ {
+			response := <-repairChan
+			if err == nil && outcome(response.Error) == "error" {
+				err = response.Error
+			}
+		}
+		span.End(err)
+	}()
+	return repairChan
+}
+
+// endSpan sets the outcome of the given span from the given error and ends it. Cache misses and failed conditions are
+// outcomes, not errors.
+func endSpan(span Span, err error) {
+	result := outcome(err)
+	span.SetAttribute("memcacheha.outcome", result)
+	if result != "error" {
+		err = nil
+	}
+	span.End(err)
+}
+
+// outcome returns the outcome of a call that returned the given error: ok, miss, not_stored, conflict or error
+func outcome(err error) string {
+	switch err {
+	case nil:
+		return "ok"
+	case memcache.ErrCacheMiss:
+		return "miss"
+	case memcache.ErrNotStored:
+		return "not_stored"
+	case memcache.ErrCASConflict:
+		return "conflict"
+	}
+	return "error"
+}
+
+// responseBytes returns the length of the values in the given response
+func responseBytes(response *NodeResponse) int {
+	bytes := 0
+	if response.Item != nil {
+		bytes += len(response.Item.Value)
+	}
+	for _, item := range response.Items {
+		bytes += len(item.Value)
+	}
+	return bytes
+}
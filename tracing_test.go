@@ -0,0 +1,113 @@
+package memcacheha
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+type testSpanKey struct{}
+
+type testSpan struct {
+	name       string
+	parent     *testSpan
+	linked     *testSpan
+	attributes map[string]interface{}
+	err        error
+	ended      bool
+}
+
+func (span *testSpan) SetAttribute(key string, value interface{}) {
+	span.attributes[key] = value
+}
+
+func (span *testSpan) End(err error) {
+	span.err, span.ended = err, true
+}
+
+type testTracer struct {
+	lock  sync.Mutex
+	spans []*testSpan
+}
+
+func (tracer *testTracer) start(ctx context.Context, name string) *testSpan {
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+	span := &testSpan{name: name, attributes: map[string]interface{}{}}
+	tracer.spans = append(tracer.spans, span)
+	return span
+}
+
+func (tracer *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := tracer.start(ctx, name)
+	span.parent, _ = ctx.Value(testSpanKey{}).(*testSpan)
+	return context.WithValue(ctx, testSpanKey{}, span), span
+}
+
+func (tracer *testTracer) StartLinked(ctx context.Context, name string) Span {
+	span := tracer.start(ctx, name)
+	span.linked, _ = ctx.Value(testSpanKey{}).(*testSpan)
+	return span
+}
+
+func TestClientTracing(t *testing.T) {
+	tracer := &testTracer{}
+	source := &testNodeSource{nodes: []string{"127.0.0.1:1"}}
+	client := New(WithLogger(testLogger{}), WithSources(source), WithTracer(tracer))
+	client.GetNodes()
+	client.Nodes.GetNodes()["127.0.0.1:1"].markHealthy()
+
+	if err := client.Set(&Item{Key: "key", Value: []byte("value")}); err == nil {
+		t.Fatal("expected error writing to unreachable node")
+	}
+
+	if len(tracer.spans) != 2 {
+		t.Fatalf("expected operation and node spans, got %d", len(tracer.spans))
+	}
+	opSpan, nodeSpan := tracer.spans[0], tracer.spans[1]
+	if opSpan.name != "memcacheha.Set" || opSpan.attributes["memcacheha.key"] != "key" || !opSpan.ended || opSpan.err == nil {
+		t.Errorf("expected failed Set span, got %+v", opSpan)
+	}
+	if nodeSpan.name != "memcacheha.Node.Set" || nodeSpan.parent != opSpan || nodeSpan.err == nil {
+		t.Errorf("expected failed node span in Set span, got %+v", nodeSpan)
+	}
+	if nodeSpan.attributes["memcacheha.endpoint"] != "127.0.0.1:1" || nodeSpan.attributes["memcacheha.bytes"] != 5 {
+		t.Errorf("expected endpoint and bytes, got %v", nodeSpan.attributes)
+	}
+
+	// Repairs are traced in a linked span, ending when all nodes respond
+	ctx, parent := tracer.Start(context.Background(), "parent")
+	repairChan := client.traceRepair(ctx, "Get", "key", 1)
+	repairChan <- NewNodeResponse(nil, nil, nil)
+	repairSpan := tracer.spans[3]
+	if repairSpan.name != "memcacheha.Repair" || repairSpan.linked != parent || repairSpan.attributes["memcacheha.op"] != "Get" {
+		t.Errorf("expected repair span linked to parent, got %+v", repairSpan)
+	}
+}
+
+func TestClientTracingAddRepair(t *testing.T) {
+	tracer := &testTracer{}
+	client, servers := newTestCluster(t, 2, WithTracer(tracer))
+	existing := (&Item{Key: "foo", Value: []byte("old")}).AsMemcacheItem()
+	if err := client.Nodes.GetNodes()[servers[0].endpoint()].client.Set(existing); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Add(&Item{Key: "foo", Value: []byte("new")}); err != memcache.ErrNotStored {
+		t.Fatalf("expected ErrNotStored, got %v", err)
+	}
+
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+	for _, span := range tracer.spans {
+		if span.name == "memcacheha.Repair" && span.attributes["memcacheha.op"] == "Add" {
+			if span.linked == nil || span.linked.name != "memcacheha.Add" || span.attributes["memcacheha.nodes"] != 1 {
+				t.Errorf("expected repair of 1 node linked to Add span, got %+v", span)
+			}
+			return
+		}
+	}
+	t.Error("expected Add repair span")
+}
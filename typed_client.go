@@ -0,0 +1,129 @@
+package memcacheha
+
+import (
+	"context"
+	"time"
+)
+
+// TypedClient reads and writes values of type T through a Client, marshaled with a Codec. Values read that were not
+// written with the same Codec return ErrCodecMismatch, except for raw keys (see Encoding.Raw).
+type TypedClient[T any] struct {
+	Client *Client
+	Codec  Codec
+}
+
+// NewTypedClient returns a new TypedClient for the given Client, using the given Codec
+func NewTypedClient[T any](client *Client, codec Codec) *TypedClient[T] {
+	return &TypedClient[T]{
+		Client: client,
+		Codec:  codec,
+	}
+}
+
+// Add writes the given value for the given key, if no value already exists for the key, as Client.Add
+func (typed *TypedClient[T]) Add(key string, value T, expiration *time.Time) error {
+	return typed.AddContext(context.Background(), key, value, expiration)
+}
+
+// AddContext is like Add, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (typed *TypedClient[T]) AddContext(ctx context.Context, key string, value T, expiration *time.Time) error {
+	item, err := typed.marshal(key, value, expiration)
+	if err != nil {
+		return err
+	}
+	return typed.Client.AddContext(ctx, item)
+}
+
+// Replace writes the given value for the given key, if a value already exists for the key, as Client.Replace
+func (typed *TypedClient[T]) Replace(key string, value T, expiration *time.Time) error {
+	return typed.ReplaceContext(context.Background(), key, value, expiration)
+}
+
+// ReplaceContext is like Replace, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (typed *TypedClient[T]) ReplaceContext(ctx context.Context, key string, value T, expiration *time.Time) error {
+	item, err := typed.marshal(key, value, expiration)
+	if err != nil {
+		return err
+	}
+	return typed.Client.ReplaceContext(ctx, item)
+}
+
+// Set writes the given value for the given key, unconditionally.
+func (typed *TypedClient[T]) Set(key string, value T, expiration *time.Time) error {
+	return typed.SetContext(context.Background(), key, value, expiration)
+}
+
+// SetContext is like Set, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (typed *TypedClient[T]) SetContext(ctx context.Context, key string, value T, expiration *time.Time) error {
+	item, err := typed.marshal(key, value, expiration)
+	if err != nil {
+		return err
+	}
+	return typed.Client.SetContext(ctx, item)
+}
+
+// Get gets the value for the given key. ErrCacheMiss is returned for a memcache cache miss.
+func (typed *TypedClient[T]) Get(key string) (T, error) {
+	return typed.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (typed *TypedClient[T]) GetContext(ctx context.Context, key string) (T, error) {
+	item, err := typed.Client.GetContext(ctx, key)
+	if err != nil {
+		var value T
+		return value, err
+	}
+	return typed.unmarshal(item)
+}
+
+// GetMulti is a batch version of Get. Values that cannot be unmarshaled are left out, and the first error unmarshaling is
+// returned, unless reading returned an error.
+func (typed *TypedClient[T]) GetMulti(keys []string) (map[string]T, error) {
+	return typed.GetMultiContext(context.Background(), keys)
+}
+
+// GetMultiContext is like GetMulti, but returns ctx.Err() if ctx is done before all nodes have responded.
+func (typed *TypedClient[T]) GetMultiContext(ctx context.Context, keys []string) (map[string]T, error) {
+	items, err := typed.Client.GetMultiContext(ctx, keys)
+	if items == nil {
+		return nil, err
+	}
+	values := map[string]T{}
+	for key, item := range items {
+		value, unmarshalErr := typed.unmarshal(item)
+		if unmarshalErr != nil {
+			if err == nil {
+				err = unmarshalErr
+			}
+			continue
+		}
+		values[key] = value
+	}
+	return values, err
+}
+
+// marshal returns an Item holding the given value, marshaled with the Codec
+func (typed *TypedClient[T]) marshal(key string, value T, expiration *time.Time) (*Item, error) {
+	data, err := typed.Codec.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return &Item{
+		Key:        key,
+		Value:      data,
+		Expiration: expiration,
+		codec:      typed.Codec.Name(),
+	}, nil
+}
+
+// unmarshal returns the value of the given Item, if it was written with the Codec
+func (typed *TypedClient[T]) unmarshal(item *Item) (T, error) {
+	var value T
+	if item.codec != typed.Codec.Name() && !typed.Client.Encoding.isRaw(item.Key) {
+		typed.Client.Log.Warn("Reading %s: written with codec %q, not %q", item.Key, item.codec, typed.Codec.Name())
+		return value, ErrCodecMismatch
+	}
+	err := typed.Codec.Unmarshal(item.Value, &value)
+	return value, err
+}
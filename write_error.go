@@ -0,0 +1,120 @@
+package memcacheha
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// NodeError is an error returned by the node with the given endpoint
+type NodeError struct {
+	Endpoint string
+	Err      error
+
+	// Transport is true if the node could not be contacted or failed, which marks it unhealthy. Otherwise the node, or
+	// the client before sending, rejected the operation, e.g. with memcache.ErrMalformedKey.
+	Transport bool
+}
+
+func (err *NodeError) Error() string {
+	return err.Endpoint + ": " + err.Err.Error()
+}
+
+func (err *NodeError) Unwrap() error {
+	return err.Err
+}
+
+// WriteError is returned by a write that was rejected by any node, or not acknowledged by enough nodes to meet the
+// write consistency. Err is the first rejection, or ErrInsufficientReplicas, and Nodes holds the error of every node
+// that failed.
+type WriteError struct {
+	Err   error
+	Nodes []*NodeError
+}
+
+func (err *WriteError) Error() string {
+	nodeErrs := make([]string, len(err.Nodes))
+	for i, nodeErr := range err.Nodes {
+		nodeErrs[i] = nodeErr.Error()
+	}
+	return fmt.Sprintf("%s (%s)", err.Err, strings.Join(nodeErrs, ", "))
+}
+
+func (err *WriteError) Unwrap() error {
+	return err.Err
+}
+
+// isTransportError returns true if the given error from gomemcache is a failure of the node, rather than a response
+func isTransportError(err error) bool {
+	switch err {
+	case nil,
+		memcache.ErrCacheMiss,
+		memcache.ErrCASConflict,
+		memcache.ErrNotStored,
+		memcache.ErrNoStats,
+		memcache.ErrMalformedKey:
+		return false
+	}
+	return !isErrorReply(err)
+}
+
+// isErrorReply returns true if the given error from gomemcache is a SERVER_ERROR or CLIENT_ERROR reply, e.g.
+// "SERVER_ERROR object too large for cache", which gomemcache returns as an unexpected response line. The node
+// rejected the operation, but is healthy.
+func isErrorReply(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, `"SERVER_ERROR `) ||
+		strings.Contains(message, `"CLIENT_ERROR `) ||
+		strings.HasPrefix(message, "memcache: client error: ")
+}
+
+// writeResult collects the responses from nodes for a write
+type writeResult struct {
+	acks   int
+	errors []*NodeError
+}
+
+// add records the given response, counting it as an acknowledgement if successful. Errors in expected are results of
+// the write handled by the caller, and are not recorded.
+func (result *writeResult) add(response *NodeResponse, expected ...error) {
+	if response.Error == nil {
+		result.acks++
+		return
+	}
+	for _, err := range expected {
+		if response.Error == err {
+			return
+		}
+	}
+	nodeErr, ok := response.Error.(*NodeError)
+	if !ok {
+		nodeErr = &NodeError{
+			Endpoint:  response.Node.Endpoint,
+			Err:       response.Error,
+			Transport: isTransportError(response.Error),
+		}
+	}
+	result.errors = append(result.errors, nodeErr)
+}
+
+// rejection returns the first error that is not a transport error, or nil
+func (result *writeResult) rejection() error {
+	for _, nodeErr := range result.errors {
+		if !nodeErr.Transport {
+			return nodeErr.Err
+		}
+	}
+	return nil
+}
+
+// err returns a WriteError if any node rejected the write, or fewer than required nodes (and at least one) acknowledged it
+func (result *writeResult) err(required int) error {
+	if rejection := result.rejection(); rejection != nil {
+		return &WriteError{Err: rejection, Nodes: result.errors}
+	}
+	if result.acks == 0 || result.acks < required {
+		return &WriteError{Err: ErrInsufficientReplicas, Nodes: result.errors}
+	}
+	return nil
+}
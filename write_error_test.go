@@ -0,0 +1,100 @@
+package memcacheha
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func TestWriteResult(t *testing.T) {
+	a, b := &Node{Endpoint: "a:11211"}, &Node{Endpoint: "b:11211"}
+	timeout := errors.New("i/o timeout")
+
+	// A transport failure is tolerated if enough nodes acknowledged the write
+	result := &writeResult{}
+	result.add(NewNodeResponse(a, nil, nil))
+	result.add(NewNodeResponse(b, nil, timeout))
+	if err := result.err(1); err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+	err := result.err(2)
+	if !errors.Is(err, ErrInsufficientReplicas) {
+		t.Errorf("expected ErrInsufficientReplicas, got %v", err)
+	}
+	var writeErr *WriteError
+	if !errors.As(err, &writeErr) || len(writeErr.Nodes) != 1 || !writeErr.Nodes[0].Transport || writeErr.Nodes[0].Endpoint != b.Endpoint {
+		t.Errorf("expected transport error from %s, got %+v", b.Endpoint, writeErr)
+	}
+
+	// A rejection is always returned
+	result = &writeResult{}
+	result.add(NewNodeResponse(a, nil, nil))
+	result.add(NewNodeResponse(b, nil, memcache.ErrMalformedKey))
+	if err := result.err(0); !errors.Is(err, memcache.ErrMalformedKey) {
+		t.Errorf("expected ErrMalformedKey, got %v", err)
+	}
+
+	// Expected errors are not recorded, but a write must be acknowledged by one node
+	result = &writeResult{}
+	result.add(NewNodeResponse(a, nil, memcache.ErrNotStored), memcache.ErrNotStored)
+	if len(result.errors) != 0 {
+		t.Errorf("expected no errors, got %v", result.errors)
+	}
+	if err := result.err(0); !errors.Is(err, ErrInsufficientReplicas) {
+		t.Errorf("expected ErrInsufficientReplicas, got %v", err)
+	}
+}
+
+func TestWriteErrorReply(t *testing.T) {
+	client, servers := newTestCluster(t, 2)
+	servers[0].setReject("SERVER_ERROR object too large for cache")
+
+	// A SERVER_ERROR reply rejects the write, and the node stays healthy
+	err := client.Set(&Item{Key: "foo", Value: []byte("bar")})
+	var writeErr *WriteError
+	if !errors.As(err, &writeErr) || len(writeErr.Nodes) != 1 {
+		t.Fatalf("expected WriteError, got %v", err)
+	}
+	if nodeErr := writeErr.Nodes[0]; nodeErr.Transport || nodeErr.Endpoint != servers[0].endpoint() {
+		t.Errorf("expected rejection from %s, got %+v", servers[0].endpoint(), nodeErr)
+	}
+	if client.Nodes.GetHealthyNodeCount() != 2 {
+		t.Errorf("expected 2 healthy nodes, got %d", client.Nodes.GetHealthyNodeCount())
+	}
+
+	// Rejected by every node, the write still returns a WriteError
+	servers[1].setReject("SERVER_ERROR object too large for cache")
+	err = client.Set(&Item{Key: "foo", Value: []byte("bar")})
+	if !errors.As(err, &writeErr) || len(writeErr.Nodes) != 2 {
+		t.Errorf("expected WriteError from both nodes, got %v", err)
+	}
+}
+
+func TestCompareAndSwapErrorReply(t *testing.T) {
+	client, servers := newTestCluster(t, 2)
+	if err := client.Set(&Item{Key: "counter", Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The swap wins on one node, and is rejected by the other
+	item, err := client.GetForUpdate("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers[0].setReject("SERVER_ERROR out of memory storing object")
+	item.Value = []byte("2")
+	var writeErr *WriteError
+	if err := client.CompareAndSwap(item); !errors.As(err, &writeErr) || len(writeErr.Nodes) != 1 || writeErr.Nodes[0].Transport {
+		t.Errorf("expected WriteError with rejection, got %v", err)
+	}
+
+	// Operations built on CompareAndSwap return the rejection
+	servers[1].setReject("SERVER_ERROR out of memory storing object")
+	if _, err := client.Increment("counter", 1); !errors.As(err, &writeErr) || len(writeErr.Nodes) != 2 {
+		t.Errorf("expected WriteError from both nodes, got %v", err)
+	}
+	if client.Nodes.GetHealthyNodeCount() != 2 {
+		t.Errorf("expected 2 healthy nodes, got %d", client.Nodes.GetHealthyNodeCount())
+	}
+}